@@ -0,0 +1,328 @@
+package gowasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/icexin/gowasm/js"
+)
+
+const (
+	sectionType   = 1
+	sectionImport = 2
+
+	externalFunction = 0
+	externalTable    = 1
+	externalMemory   = 2
+	externalGlobal   = 3
+)
+
+// Import is an import of a wasm module
+type Import struct {
+	Module string
+	Field  string
+	// Func is true for function imports
+	Func bool
+	// Type is the wasm signature of a function import
+	Type Signature
+}
+
+func (i Import) String() string {
+	return i.Module + "." + i.Field
+}
+
+// ReadImports returns the imports of the wasm binary code
+func ReadImports(code []byte) ([]Import, error) {
+	var imports []Import
+	var types []Signature
+	err := walkSections(code, func(id byte, payload []byte) error {
+		if id == sectionType {
+			var err error
+			types, err = readTypes(bytes.NewReader(payload))
+			return err
+		}
+		if id != sectionImport {
+			return nil
+		}
+		r := bytes.NewReader(payload)
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errBadModule
+		}
+		for i := uint64(0); i < count; i++ {
+			var imp Import
+			if imp.Module, err = readName(r); err != nil {
+				return err
+			}
+			if imp.Field, err = readName(r); err != nil {
+				return err
+			}
+			kind, err := r.ReadByte()
+			if err != nil {
+				return errBadModule
+			}
+			imp.Func = kind == externalFunction
+			if imp.Func {
+				idx, err := binary.ReadUvarint(r)
+				if err != nil || idx >= uint64(len(types)) {
+					return errBadModule
+				}
+				imp.Type = types[idx]
+			} else if err := skipImportDesc(r, kind); err != nil {
+				return err
+			}
+			imports = append(imports, imp)
+		}
+		return nil
+	})
+	return imports, err
+}
+
+// readTypes reads the function types of the type section r
+func readTypes(r *bytes.Reader) ([]Signature, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, errBadModule
+	}
+	types := make([]Signature, count)
+	for i := range types {
+		if form, err := r.ReadByte(); err != nil || form != 0x60 {
+			return nil, errBadModule
+		}
+		if types[i].Params, err = readValueTypes(r); err != nil {
+			return nil, err
+		}
+		if types[i].Results, err = readValueTypes(r); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+// wasmValueTypes are the ValueTypes by their encoding, the other types
+// are kept as their encoding and match no host function
+var wasmValueTypes = map[byte]ValueType{
+	0x7f: I32,
+	0x7e: I64,
+	0x7d: F32,
+	0x7c: F64,
+}
+
+func readValueTypes(r *bytes.Reader) ([]ValueType, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errBadModule
+	}
+	var vts []ValueType
+	for i := uint64(0); i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errBadModule
+		}
+		vt, ok := wasmValueTypes[b]
+		if !ok {
+			vt = ValueType(b)
+		}
+		vts = append(vts, vt)
+	}
+	return vts, nil
+}
+
+// skipImportDesc skips the description of an import of kind other than
+// a function
+func skipImportDesc(r *bytes.Reader, kind byte) error {
+	var err error
+	switch kind {
+	case externalTable:
+		if _, err = r.ReadByte(); err == nil {
+			err = skipLimits(r)
+		}
+	case externalMemory:
+		err = skipLimits(r)
+	case externalGlobal:
+		_, err = r.Seek(2, 1)
+	default:
+		return errBadModule
+	}
+	if err != nil {
+		return errBadModule
+	}
+	return nil
+}
+
+func skipLimits(r *bytes.Reader) error {
+	flags, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if _, err := binary.ReadUvarint(r); err != nil {
+		return err
+	}
+	if flags&1 != 0 {
+		_, err = binary.ReadUvarint(r)
+	}
+	return err
+}
+
+// ABI is the host interface a guest was compiled for
+type ABI int
+
+const (
+	// ABIGo is the js port of go1.12 and go1.13, importing from go
+	ABIGo ABI = iota
+	// ABIGo111 is the js port of go1.11, resumed by calling run again
+	ABIGo111
+	// ABIGoJS is the js port since go1.21, importing from gojs
+	ABIGoJS
+	// ABITinyGo is the js target of TinyGo, started by _start
+	ABITinyGo
+	// ABIWASI is the wasip1 port of the go toolchain, started by _start
+	ABIWASI
+	// ABIGo114 is the js port of go1.14 to go1.20, importing from go like
+	// ABIGo but boxing the js values like ABIGoJS
+	ABIGo114
+)
+
+func (a ABI) String() string {
+	switch a {
+	case ABIGo:
+		return "go"
+	case ABIGo111:
+		return "go1.11"
+	case ABIGoJS:
+		return "gojs"
+	case ABITinyGo:
+		return "tinygo"
+	case ABIWASI:
+		return "wasi"
+	case ABIGo114:
+		return "go1.14"
+	}
+	return "unknown"
+}
+
+// refEncoding returns how the guests of the ABI box the js values
+func (a ABI) refEncoding() js.Encoding {
+	switch a {
+	case ABIGo114, ABIGoJS, ABITinyGo:
+		return js.EncodingGo114
+	}
+	return js.EncodingGo112
+}
+
+// DetectABI returns the ABI of a module from its imports, ABIGo if they
+// don't tell
+func DetectABI(imports []Import) ABI {
+	abi, _ := detectABI(imports)
+	return abi
+}
+
+// detectABI returns the ABI of a module from its imports, false if none
+// of them belongs to a known runtime
+func detectABI(imports []Import) (ABI, bool) {
+	var gojs, golegacy, go111, go114, wasi bool
+	for _, imp := range imports {
+		switch {
+		case imp.Field == "runtime.ticks" || imp.Field == "runtime.sleepTicks":
+			return ABITinyGo, true
+		case imp.Module == "env" && strings.HasPrefix(imp.Field, "syscall/js."):
+			return ABITinyGo, true
+		case imp.Module == "gojs":
+			gojs = true
+		case imp.Module == "go":
+			golegacy = true
+			switch imp.Field {
+			case "runtime.scheduleCallback", "runtime.clearScheduledCallback":
+				go111 = true
+			case "syscall/js.finalizeRef":
+				// added by go1.14 with the new boxing of the js values
+				go114 = true
+			}
+		case imp.Module == wasiModule:
+			wasi = true
+		}
+	}
+	switch {
+	case gojs:
+		return ABIGoJS, true
+	case go111:
+		return ABIGo111, true
+	case go114:
+		return ABIGo114, true
+	case golegacy:
+		return ABIGo, true
+	case wasi:
+		return ABIWASI, true
+	}
+	return ABIGo, false
+}
+
+// ModuleInfo describes the toolchain and the imports of a module
+type ModuleInfo struct {
+	Imports []Import
+	// BuildInfo is nil if the module has none
+	BuildInfo *BuildInfo
+	ABI       ABI
+}
+
+// Inspect reads the imports and the build information of the wasm binary
+// code and returns the ABI it needs. The imports decide, the go version
+// only when they don't belong to a known runtime.
+func Inspect(code []byte) (*ModuleInfo, error) {
+	imports, err := ReadImports(code)
+	if err != nil {
+		return nil, err
+	}
+	binfo, err := ReadBuildInfo(code)
+	if err != nil {
+		return nil, err
+	}
+	info := &ModuleInfo{
+		Imports:   imports,
+		BuildInfo: binfo,
+	}
+	var ok bool
+	info.ABI, ok = detectABI(imports)
+	if !ok && binfo != nil {
+		minor, _ := goMinor(binfo.GoVersion)
+		switch {
+		case binfo.GOOS == "wasip1":
+			info.ABI = ABIWASI
+		case minor >= 21:
+			info.ABI = ABIGoJS
+		case minor >= 14:
+			info.ABI = ABIGo114
+		}
+	}
+	return info, nil
+}
+
+// NewRunner inspects the wasm binary code, registers on r the runtime of
+// its ABI and returns it, a *Runtime or a *WASI. The host modules of the
+// guest must be registered on r before, NewRunner validates the imports
+// with Resolver.Validate and fails with an *ImportsError listing all the
+// imports r can't resolve.
+func NewRunner(code []byte, r *Resolver) (Runner, *ModuleInfo, error) {
+	info, err := Inspect(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	var runner Runner
+	if info.ABI == ABIWASI {
+		w := NewWASI()
+		w.Register(r)
+		runner = w
+	} else {
+		rt := NewRuntime()
+		rt.SetABI(info.ABI)
+		rt.Register(r)
+		runner = rt
+	}
+
+	if err := r.Validate(info.Imports); err != nil {
+		err.(*ImportsError).Module = info
+		return nil, info, err
+	}
+	return runner, info, nil
+}
@@ -0,0 +1,118 @@
+package gowasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// the sentinels around the module information the go linker embeds in
+// the data of binaries built in module mode, see runtime/debug
+var (
+	modinfoStart = []byte("0w\xaf\x0c\x92t\x08\x02A\xe1\xc1\x07\xe6\xd6\x18\xe6")
+	modinfoEnd   = []byte("\xf92C1\x86\x18 r\x00\x82B\x10A\x16\xd8\xf2")
+)
+
+// BuildInfo is the build information of a binary built by the go
+// toolchain
+type BuildInfo struct {
+	// GoVersion is the version of the toolchain, like go1.22.3, read
+	// from the producers section, empty if the binary has none
+	GoVersion string
+	// GOOS is the GOOS setting of the build, read from the module
+	// information of go1.18 and later
+	GOOS string
+}
+
+// ReadBuildInfo returns the build information of the wasm binary code,
+// nil if it has none, as the binaries built by TinyGo or outside of a
+// module by old toolchains
+func ReadBuildInfo(code []byte) (*BuildInfo, error) {
+	var info BuildInfo
+	err := walkSections(code, func(id byte, payload []byte) error {
+		if id != sectionCustom {
+			return nil
+		}
+		r := bytes.NewReader(payload)
+		name, err := readName(r)
+		if err != nil || name != "producers" {
+			return err
+		}
+		info.GoVersion, err = readProducer(r, "language", "Go")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.Index(code, modinfoStart); i >= 0 {
+		modinfo := code[i+len(modinfoStart):]
+		if j := bytes.Index(modinfo, modinfoEnd); j >= 0 {
+			info.GOOS = modinfoSetting(string(modinfo[:j]), "GOOS")
+		}
+	}
+	if info == (BuildInfo{}) {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// readProducer returns the version of the value name of the field of the
+// producers section r, empty if there is none
+func readProducer(r *bytes.Reader, field, name string) (string, error) {
+	nfields, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", errBadModule
+	}
+	for i := uint64(0); i < nfields; i++ {
+		fname, err := readName(r)
+		if err != nil {
+			return "", err
+		}
+		nvalues, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", errBadModule
+		}
+		for j := uint64(0); j < nvalues; j++ {
+			vname, err := readName(r)
+			if err != nil {
+				return "", err
+			}
+			version, err := readName(r)
+			if err != nil {
+				return "", err
+			}
+			if fname == field && vname == name {
+				return version, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// modinfoSetting returns the build setting key of the module information
+func modinfoSetting(modinfo, key string) string {
+	prefix := "build\t" + key + "="
+	for _, line := range strings.Split(modinfo, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+// goMinor returns the minor version of the go version v, like 20 for
+// go1.20.3, and false if v isn't a go version
+func goMinor(v string) (int, bool) {
+	i := strings.Index(v, "go1.")
+	if i < 0 {
+		return 0, false
+	}
+	v = v[i+len("go1."):]
+	end := 0
+	for end < len(v) && v[end] >= '0' && v[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(v[:end])
+	return n, err == nil
+}
@@ -0,0 +1,23 @@
+package gowasm
+
+import "time"
+
+// clock is the time source of a guest, its monotonic time counts from the
+// creation of the clock
+type clock struct {
+	origin time.Time
+}
+
+func newClock() clock {
+	return clock{origin: time.Now()}
+}
+
+// monotonic returns the nanoseconds elapsed since the creation of c
+func (c clock) monotonic() int64 {
+	return int64(time.Since(c.origin))
+}
+
+// wall returns the nanoseconds elapsed since the unix epoch
+func (c clock) wall() int64 {
+	return time.Now().UnixNano()
+}
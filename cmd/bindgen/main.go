@@ -0,0 +1,351 @@
+// Command bindgen generates the bindings of a host module described by a Go
+// interface, for go generate:
+//
+//	//go:generate go run github.com/icexin/gowasm/cmd/bindgen -type Calc
+//
+// For an interface Calc it writes four files next to the interface:
+//
+//	calc_bind.go          RegisterCalc, registering an implementation of Calc
+//	                      on a gowasm.Registry (!js)
+//	calc_bind_js.go       the guest functions, one per method (js)
+//	calc_bind_go111_js.go the same for toolchains before go1.21, with
+//	calc_bind_js_wasm.s   their CallImport stubs
+//
+// The guest functions are named after the methods and call the host with the
+// frame laid out by the Go compiler, which the host functions decode without
+// reflection. Both sides are compiled from the interface, so a change of a
+// method signature doesn't go unnoticed by either side.
+//
+// Parameters can be bools, int, int32, int64, uint, uint32, uint64, uintptr,
+// float64, strings and []byte. Results can be of the same types except
+// strings and []byte, which would have to be allocated in the guest memory.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	typeName = flag.String("type", "", "name of the interface describing the host module")
+	pkgPath  = flag.String("path", "", "import path of the guest package, default is the package in the directory")
+	dir      = flag.String("dir", ".", "directory of the package")
+)
+
+// kind tells how a type is read from and written to a call frame
+type kind struct {
+	read     string // CallFrame method reading an argument
+	readType string
+	set      string // CallFrame method writing a result, empty if it can't be returned
+	setType  string
+}
+
+var kinds = map[string]kind{
+	"bool":    {"Bool", "bool", "SetBool", "bool"},
+	"int":     {"Int64", "int64", "SetInt64", "int64"},
+	"int32":   {"Int32", "int32", "SetInt32", "int32"},
+	"int64":   {"Int64", "int64", "SetInt64", "int64"},
+	"uint":    {"Uint64", "uint64", "SetInt64", "int64"},
+	"uint32":  {"Uint32", "uint32", "SetInt32", "int32"},
+	"uint64":  {"Uint64", "uint64", "SetInt64", "int64"},
+	"uintptr": {"Uint64", "uint64", "SetInt64", "int64"},
+	"float64": {"Float64", "float64", "SetFloat64", "float64"},
+	"string":  {"Str", "string", "", ""},
+	"[]byte":  {"Bytes", "[]byte", "", ""},
+}
+
+// param is a parameter or a result of a method
+type param struct {
+	name string
+	typ  string
+	kind kind
+}
+
+type method struct {
+	name string
+	doc  string
+	sig  string // the signature without func
+	in   []param
+	out  []param
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bindgen: ")
+	flag.Parse()
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	pkg, methods, err := parseInterface(*dir, *typeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	path := *pkgPath
+	if path == "" {
+		path, err = importPath(*dir, pkg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	g := &generator{
+		pkg:     pkg,
+		path:    path,
+		iface:   *typeName,
+		methods: methods,
+	}
+	base := filepath.Join(*dir, strings.ToLower(*typeName)+"_bind")
+	files := []struct {
+		name string
+		gen  func() []byte
+	}{
+		{base + ".go", g.host},
+		{base + "_js.go", g.guest},
+		{base + "_go111_js.go", g.legacyGuest},
+		{base + "_js_wasm.s", g.stubs},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(f.name, f.gen(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// parseInterface returns the package name and the methods of the interface
+// name declared in the package in dir
+func parseInterface(dir, name string) (string, []method, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+	for pkg, p := range pkgs {
+		for _, file := range p.Files {
+			obj := file.Scope.Lookup(name)
+			if obj == nil || obj.Kind != ast.Typ {
+				continue
+			}
+			spec := obj.Decl.(*ast.TypeSpec)
+			iface, ok := spec.Type.(*ast.InterfaceType)
+			if !ok {
+				return "", nil, fmt.Errorf("%s is not an interface", name)
+			}
+			methods, err := parseMethods(fset, iface)
+			return pkg, methods, err
+		}
+	}
+	return "", nil, fmt.Errorf("interface %s not found in %s", name, dir)
+}
+
+func parseMethods(fset *token.FileSet, iface *ast.InterfaceType) ([]method, error) {
+	var methods []method
+	for _, field := range iface.Methods.List {
+		if len(field.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", fset.Position(field.Pos()))
+		}
+		ft := field.Type.(*ast.FuncType)
+		m := method{
+			name: field.Names[0].Name,
+			doc:  field.Doc.Text(),
+		}
+		var sig bytes.Buffer
+		printer.Fprint(&sig, fset, ft)
+		m.sig = strings.TrimPrefix(sig.String(), "func")
+
+		var err error
+		m.in, err = parseParams(fset, ft.Params, "a")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m.name, err)
+		}
+		m.out, err = parseParams(fset, ft.Results, "r")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m.name, err)
+		}
+		for _, p := range m.out {
+			if p.kind.set == "" {
+				return nil, fmt.Errorf("%s: %s can't be returned to the guest", m.name, p.typ)
+			}
+		}
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
+
+// parseParams returns the parameters of a field list. They are named
+// prefix0, prefix1... in the generated code, the names of the interface
+// could clash with the names used by the trampolines.
+func parseParams(fset *token.FileSet, list *ast.FieldList, prefix string) ([]param, error) {
+	if list == nil {
+		return nil, nil
+	}
+	var params []param
+	for _, field := range list.List {
+		var typ bytes.Buffer
+		printer.Fprint(&typ, fset, field.Type)
+		k, ok := kinds[typ.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %s", typ.String())
+		}
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, param{
+				name: prefix + strconv.Itoa(len(params)),
+				typ:  typ.String(),
+				kind: k,
+			})
+		}
+	}
+	return params, nil
+}
+
+// importPath returns the import path of the package in dir, as used by the
+// linker in the names of the guest imports
+func importPath(dir, pkg string) (string, error) {
+	if pkg == "main" {
+		return "main", nil
+	}
+	out, err := exec.Command("go", "list", "-f", "{{.ImportPath}}", dir).Output()
+	if err != nil {
+		return "", fmt.Errorf("could not find the import path of %s: %v", dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+type generator struct {
+	pkg     string
+	path    string
+	iface   string
+	methods []method
+}
+
+func (g *generator) header(buf *bytes.Buffer, constraint, legacy string) {
+	fmt.Fprintf(buf, "// Code generated by bindgen -type %s. DO NOT EDIT.\n\n", g.iface)
+	fmt.Fprintf(buf, "//go:build %s\n// +build %s\n\n", constraint, legacy)
+	fmt.Fprintf(buf, "package %s\n\n", g.pkg)
+}
+
+// field returns the import name of the method m
+func (g *generator) field(m method) string {
+	return g.path + "." + m.name
+}
+
+func (g *generator) host() []byte {
+	var buf bytes.Buffer
+	g.header(&buf, "!js", "!js")
+	fmt.Fprintf(&buf, "import \"github.com/icexin/gowasm\"\n\n")
+	fmt.Fprintf(&buf, "// Register%s registers impl as the host side of the functions of the\n", g.iface)
+	fmt.Fprintf(&buf, "// package %s compiled for js.\n", g.path)
+	fmt.Fprintf(&buf, "func Register%s(r gowasm.Registry, impl %s) {\n", g.iface, g.iface)
+	// go1.21 moved the imports of the js port from go to gojs
+	fmt.Fprintf(&buf, "for _, module := range []string{\"go\", \"gojs\"} {\n")
+	for _, m := range g.methods {
+		fmt.Fprintf(&buf, "r.Register(module, %q, func(f *gowasm.CallFrame) {\n", g.field(m))
+		var args []string
+		for _, p := range m.in {
+			read := "f." + p.kind.read + "()"
+			if p.typ != p.kind.readType {
+				read = p.typ + "(" + read + ")"
+			}
+			fmt.Fprintf(&buf, "%s := %s\n", p.name, read)
+			args = append(args, p.name)
+		}
+		if len(m.in) != 0 {
+			fmt.Fprintf(&buf, "if f.Err() != nil {\nreturn\n}\n")
+		}
+		call := "impl." + m.name + "(" + strings.Join(args, ", ") + ")"
+		if len(m.out) == 0 {
+			fmt.Fprintf(&buf, "%s\n", call)
+		} else {
+			var results []string
+			for _, p := range m.out {
+				results = append(results, p.name)
+			}
+			fmt.Fprintf(&buf, "%s := %s\n", strings.Join(results, ", "), call)
+		}
+		for _, p := range m.out {
+			v := p.name
+			if p.typ != p.kind.setType {
+				v = p.kind.setType + "(" + v + ")"
+			}
+			fmt.Fprintf(&buf, "f.%s(%s)\n", p.kind.set, v)
+		}
+		fmt.Fprintf(&buf, "})\n")
+	}
+	fmt.Fprintf(&buf, "}\n}\n")
+	return g.format(buf.Bytes())
+}
+
+func (g *generator) guestFuncs(buf *bytes.Buffer, directive bool) {
+	for _, m := range g.methods {
+		buf.WriteString("\n")
+		if m.doc != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(m.doc, "\n"), "\n") {
+				fmt.Fprintf(buf, "// %s\n", line)
+			}
+		}
+		if directive {
+			if m.doc != "" {
+				buf.WriteString("//\n")
+			}
+			fmt.Fprintf(buf, "//go:wasmimport gojs %s\n", g.field(m))
+		}
+		fmt.Fprintf(buf, "func %s%s\n", m.name, m.sig)
+	}
+}
+
+// guest returns the guest functions for go1.21 and later, which import
+// from gojs with the sp calling convention of the js port
+func (g *generator) guest() []byte {
+	var buf bytes.Buffer
+	g.header(&buf, "js && go1.21", "js,go1.21")
+	g.guestFuncs(&buf, true)
+	return g.format(buf.Bytes())
+}
+
+// legacyGuest returns the guest functions for the toolchains before
+// go1.21, implemented by the stubs
+func (g *generator) legacyGuest() []byte {
+	var buf bytes.Buffer
+	g.header(&buf, "js && !go1.21", "js,!go1.21")
+	g.guestFuncs(&buf, false)
+	return g.format(buf.Bytes())
+}
+
+func (g *generator) stubs() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by bindgen -type %s. DO NOT EDIT.\n\n", g.iface)
+	fmt.Fprintf(&buf, "//go:build !go1.21\n// +build !go1.21\n\n")
+	fmt.Fprintf(&buf, "#include \"textflag.h\"\n")
+	for _, m := range g.methods {
+		fmt.Fprintf(&buf, "\nTEXT ·%s(SB), NOSPLIT, $0\n\tCallImport\n\tRET\n", m.name)
+	}
+	return buf.Bytes()
+}
+
+func (g *generator) format(src []byte) []byte {
+	out, err := format.Source(src)
+	if err != nil {
+		log.Fatalf("could not format the generated code: %v\n%s", err, src)
+	}
+	return out
+}
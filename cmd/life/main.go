@@ -7,43 +7,61 @@ import (
 	"io"
 	"os"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/icexin/gowasm"
 	"github.com/perlin-network/life/exec"
-	"github.com/perlin-network/life/utils"
 )
 
 var (
-	cpuprofile = flag.String("cpuprofile", "cpu.pprof", "write cpu profile to file")
+	cpuprofile   = flag.String("cpuprofile", "", "write host cpu profile to file")
+	guestprofile = flag.String("guestprofile", "", "write the guest stacks of the host calls to file, in pprof format")
+	metrics      = flag.Bool("metrics", false, "print host call metrics to stderr on exit")
+	stubUnknown  = flag.Bool("stub-unknown", false, "stub the imports the runtime doesn't provide and report their calls on exit")
+
+	envVars  listFlag
+	envAllow listFlag
 )
 
-func run(vm *exec.VirtualMachine, entry int, argc, argv int64, rt *gowasm.Runtime) (int64, error) {
-	vm.Ignite(entry, argc, argv)
-	for !vm.Exited {
-		for !vm.Exited {
-			vm.Execute()
-			if vm.Delegate != nil {
-				vm.Delegate()
-				vm.Delegate = nil
-			}
-		}
+func init() {
+	flag.Var(&envVars, "env", "set the variable `KEY=VAL` of the guest environment, can be repeated")
+	flag.Var(&envAllow, "env-allow", "pass the host variable `NAME` to the guest, can be repeated")
+}
 
-		if !rt.Exited() {
-			rt.WaitTimer()
-			vm.Ignite(entry, argc, argv)
-		}
+// listFlag is a flag that can be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// guestEnv returns the environment of the guest, which only holds the
+// variables given by the flags
+func guestEnv() ([]string, error) {
+	env := gowasm.NewEnv()
+	if err := env.Allow(envAllow...); err != nil {
+		return nil, err
 	}
-	if vm.ExitError != nil {
-		return -1, utils.UnifyError(vm.ExitError)
+	for _, kv := range envVars {
+		if err := env.Parse(kv); err != nil {
+			return nil, err
+		}
 	}
-	return vm.ReturnValue, nil
-
+	return env.Environ(), nil
 }
 
 func main() {
 	flag.Parse()
 	if *cpuprofile != "" {
-		pf, _ := os.Create("cpu.profile")
+		pf, err := os.Create(*cpuprofile)
+		if err != nil {
+			panic(err)
+		}
 		defer pf.Close()
 		pprof.StartCPUProfile(pf)
 		defer pprof.StopCPUProfile()
@@ -59,9 +77,19 @@ func main() {
 	f.Close()
 	input := buf.Bytes()
 
+	envs, err := guestEnv()
+	if err != nil {
+		panic(err)
+	}
+
 	resolv := &Resolver{gowasm.NewResolver()}
-	rt := gowasm.NewRuntime()
-	rt.Register(resolv)
+	resolv.SetStubUnknown(*stubUnknown)
+	runner, _, err := gowasm.NewRunner(input, resolv.Resolver)
+	if err != nil {
+		pprof.StopCPUProfile()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// Instantiate a new WebAssembly VM with a few resolved imports.
 	vm, err := exec.NewVirtualMachine(input, exec.VMConfig{
@@ -73,13 +101,11 @@ func main() {
 		panic(err)
 	}
 
-	rt.SetVM(vmWrapper{vm})
+	runner.SetVM(vmWrapper{vm})
 
-	// Get the function ID of the entry function to be executed.
-	entryID, ok := vm.GetFunctionExport("run")
-	if !ok {
-		fmt.Printf("Entry function run not found;\n")
-		entryID = 0
+	syms, err := gowasm.ReadSymbols(input)
+	if err != nil {
+		fmt.Printf("could not read symbols: %v\n", err)
 	}
 
 	// If any function prior to the entry function was declared to be
@@ -88,16 +114,53 @@ func main() {
 		startID := int(vm.Module.Base.Start.Index)
 		_, err := vm.Run(startID)
 		if err != nil {
-			vm.PrintStackTrace()
-			panic(err)
+			fatal(gowasm.NewTrap(err, vmWrapper{vm}, syms))
 		}
 	}
 
-	argc, argv := gowasm.PrepareArgs(vm.Memory, flag.Args(), os.Environ())
+	var prof *gowasm.Profiler
+	if *guestprofile != "" {
+		prof = gowasm.NewProfiler(vmWrapper{vm}, syms)
+		resolv.SetProfiler(prof)
+		prof.Start()
+	}
+
 	// Run the WebAssembly module's entry function.
-	_, err = run(vm, entryID, int64(argc), int64(argv), rt)
+	err = runner.Run(flag.Args(), envs)
+	if prof != nil {
+		writeGuestProfile(prof, *guestprofile)
+	}
+	if *metrics {
+		runner.Metrics().WriteTo(os.Stderr)
+	}
+	if *stubUnknown {
+		resolv.Stubs().WriteTo(os.Stderr)
+	}
 	if err != nil {
-		vm.PrintStackTrace()
-		panic(err)
+		fatal(gowasm.NewTrap(err, vmWrapper{vm}, syms))
+	}
+	if code := runner.ExitCode(); code != 0 {
+		pprof.StopCPUProfile()
+		os.Exit(int(code))
+	}
+}
+
+// fatal prints the trap with the symbolized guest stack and exits
+func fatal(trap *gowasm.Trap) {
+	pprof.StopCPUProfile()
+	trap.WriteTo(os.Stderr)
+	os.Exit(2)
+}
+
+func writeGuestProfile(prof *gowasm.Profiler, fname string) {
+	prof.Stop()
+	f, err := os.Create(fname)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+	if _, err := prof.WriteTo(f); err != nil {
+		fmt.Println(err)
 	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/icexin/gowasm"
 	"github.com/perlin-network/life/exec"
 )
@@ -13,11 +15,47 @@ func (vm vmWrapper) Memory() []byte {
 	return vm.vm.Memory
 }
 
+func (vm vmWrapper) HasExport(name string) bool {
+	_, ok := vm.vm.GetFunctionExport(name)
+	return ok
+}
+
+func (vm vmWrapper) CallExport(name string, args ...int64) (int64, error) {
+	id, ok := vm.vm.GetFunctionExport(name)
+	if !ok {
+		return 0, fmt.Errorf("export %s not found", name)
+	}
+	return vm.vm.Run(id, args...)
+}
+
+// GuestStack implements gowasm.StackSampler. life compiles imports into
+// stub functions, so frame function ids are wasm function indices. It
+// reads the vm unsynchronized, so it is only called from host functions.
+func (vm vmWrapper) GuestStack() []uint32 {
+	v := vm.vm
+	top := v.CurrentFrame
+	if top >= len(v.CallStack) {
+		top = len(v.CallStack) - 1
+	}
+	var stack []uint32
+	for i := top; i >= 0; i-- {
+		stack = append(stack, uint32(v.CallStack[i].FunctionID))
+	}
+	return stack
+}
+
 type Resolver struct {
 	*gowasm.Resolver
 }
 
 func (r *Resolver) ResolveFunc(module, field string) exec.FunctionImport {
+	if s, ok := r.Signature(module, field); ok && !s.Frame {
+		n := len(s.Params)
+		return func(vm *exec.VirtualMachine) int64 {
+			frame := vm.GetCurrentFrame()
+			return r.CallFunc(module, field, vmWrapper{vm}, frame.Locals[:n])
+		}
+	}
 	return func(vm *exec.VirtualMachine) int64 {
 		frame := vm.GetCurrentFrame()
 		sp := frame.Locals[0]
@@ -5,11 +5,14 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/go-interpreter/wagon/exec"
 	"github.com/go-interpreter/wagon/validate"
@@ -18,11 +21,48 @@ import (
 )
 
 var (
-	verbose    = flag.Bool("v", false, "enable/disable verbose mode")
-	verify     = flag.Bool("verify-module", false, "run module verification")
-	cpuprofile = flag.String("cpuprofile", "cpu.pprof", "write cpu profile to file")
+	verbose     = flag.Bool("v", false, "enable/disable verbose mode")
+	verify      = flag.Bool("verify-module", false, "run module verification")
+	cpuprofile  = flag.String("cpuprofile", "", "write host cpu profile to file")
+	metrics     = flag.Bool("metrics", false, "print host call metrics to stderr on exit")
+	stubUnknown = flag.Bool("stub-unknown", false, "stub the imports the runtime doesn't provide and report their calls on exit")
+
+	envVars  listFlag
+	envAllow listFlag
 )
 
+func init() {
+	flag.Var(&envVars, "env", "set the variable `KEY=VAL` of the guest environment, can be repeated")
+	flag.Var(&envAllow, "env-allow", "pass the host variable `NAME` to the guest, can be repeated")
+}
+
+// listFlag is a flag that can be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// guestEnv returns the environment of the guest, which only holds the
+// variables given by the flags
+func guestEnv() ([]string, error) {
+	env := gowasm.NewEnv()
+	if err := env.Allow(envAllow...); err != nil {
+		return nil, err
+	}
+	for _, kv := range envVars {
+		if err := env.Parse(kv); err != nil {
+			return nil, err
+		}
+	}
+	return env.Environ(), nil
+}
+
 func main() {
 	flag.Parse()
 	if flag.NArg() < 1 {
@@ -30,7 +70,10 @@ func main() {
 		os.Exit(1)
 	}
 	if *cpuprofile != "" {
-		pf, _ := os.Create("cpu.profile")
+		pf, err := os.Create(*cpuprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
 		defer pf.Close()
 		pprof.StartCPUProfile(pf)
 		defer pprof.StopCPUProfile()
@@ -38,23 +81,42 @@ func main() {
 
 	wasm.SetDebugMode(*verbose)
 
-	run(flag.Arg(0), *verify)
+	code, err := run(flag.Arg(0), *verify)
+	if err != nil {
+		pprof.StopCPUProfile()
+		if trap, ok := err.(*gowasm.Trap); ok {
+			trap.WriteTo(os.Stderr)
+		} else {
+			log.Print(err)
+		}
+		os.Exit(2)
+	}
+	if code != 0 {
+		pprof.StopCPUProfile()
+		os.Exit(int(code))
+	}
 }
 
-func run(fname string, verify bool) {
-	f, err := os.Open(fname)
+// run runs the module fname and returns the exit code of the guest
+func run(fname string, verify bool) (int32, error) {
+	code, err := ioutil.ReadFile(fname)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
 
 	r := gowasm.NewResolver()
-	rt := gowasm.NewRuntime()
-	rt.Register(r)
+	r.SetStubUnknown(*stubUnknown)
+	runner, info, err := gowasm.NewRunner(code, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		log.Printf("running with the %s runtime", info.ABI)
+	}
 
-	m, err := wasm.ReadModule(f, func(name string) (*wasm.Module, error) {
-		if name == "go" {
-			return gomodule(r), nil
+	m, err := wasm.ReadModule(bytes.NewReader(code), func(name string) (*wasm.Module, error) {
+		if len(r.Fields(name)) != 0 {
+			return hostModule(r, name), nil
 		}
 		return nil, fmt.Errorf("module %s not found", name)
 	})
@@ -79,19 +141,33 @@ func run(fname string, verify bool) {
 		log.Fatalf("could not create VM: %v", err)
 	}
 
-	rt.SetVM(vm)
+	vm.RecoverPanic = true
+	wvm := vmWrapper{vm, m}
+	runner.SetVM(wvm)
 
-	entry := m.Export.Entries["run"]
-	entryid := entry.Index
+	syms, err := gowasm.ReadSymbols(code)
+	if err != nil {
+		log.Printf("could not read symbols: %v", err)
+	}
 
-	argc, argv := gowasm.PrepareArgs(vm.Memory(), flag.Args(), os.Environ())
-	for !rt.Exited() {
-		_, err = vm.ExecCode(int64(entryid), uint64(argc), uint64(argv))
-		if err != nil {
-			panic(err)
-		}
-		if !rt.Exited() {
-			rt.WaitTimer()
-		}
+	if *metrics {
+		defer func() {
+			runner.Metrics().WriteTo(os.Stderr)
+		}()
+	}
+	if *stubUnknown {
+		defer func() {
+			r.Stubs().WriteTo(os.Stderr)
+		}()
+	}
+
+	envs, err := guestEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = runner.Run(flag.Args(), envs)
+	if err != nil {
+		return 0, gowasm.NewTrap(err, wvm, syms)
 	}
+	return runner.ExitCode(), nil
 }
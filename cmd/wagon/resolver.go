@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
 	"unsafe"
 
@@ -13,59 +14,125 @@ type process struct {
 	vm *exec.VM
 }
 
-func gomodule(r *gowasm.Resolver) *wasm.Module {
-	methods := []string{
-		"debug",
-		"runtime.wasmExit",
-		"runtime.wasmWrite",
-		"runtime.nanotime",
-		"runtime.walltime",
-		"runtime.scheduleCallback",
-		"runtime.clearScheduledCallback",
-		"runtime.getRandomData",
-		"syscall/js.valueGet",
-		"syscall/js.valueSet",
-		"syscall/js.valueIndex",
-		"syscall/js.valueSetIndex",
-		"syscall/js.valueLength",
-		"syscall/js.valueNew",
-		"syscall/js.valuePrepareString",
-		"syscall/js.valueCall",
-		"syscall/js.valueInvoke",
-		"syscall/js.valueVal",
-		"syscall/js.stringVal",
-		"syscall/js.valueLoadString",
-		"syscall/js.valueInstanceOf",
+type vmWrapper struct {
+	vm     *exec.VM
+	module *wasm.Module
+}
+
+func (vm vmWrapper) Memory() []byte {
+	return vm.vm.Memory()
+}
+
+func (vm vmWrapper) HasExport(name string) bool {
+	_, ok := vm.module.Export.Entries[name]
+	return ok
+}
+
+func (vm vmWrapper) CallExport(name string, args ...int64) (int64, error) {
+	entry, ok := vm.module.Export.Entries[name]
+	if !ok {
+		return 0, fmt.Errorf("export %s not found", name)
+	}
+	params := make([]uint64, len(args))
+	for i, arg := range args {
+		params[i] = uint64(arg)
 	}
+	ret, err := vm.vm.ExecCode(int64(entry.Index), params...)
+	if err != nil {
+		return 0, err
+	}
+	switch ret := ret.(type) {
+	case uint32:
+		return int64(int32(ret)), nil
+	case uint64:
+		return int64(ret), nil
+	}
+	return 0, nil
+}
 
-	m := wasm.NewModule()
+// hostModule returns the module exporting the functions registered in the
+// module name of r
+func hostModule(r *gowasm.Resolver, name string) *wasm.Module {
+	fields := r.Fields(name)
 
+	m := wasm.NewModule()
 	m.Export.Entries = map[string]wasm.ExportEntry{}
 
-	for i, method := range methods {
-		method := method
+	for i, field := range fields {
+		s, _ := r.Signature(name, field)
 		sig := wasm.FunctionSig{
 			Form:        0,
-			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
-			ReturnTypes: nil,
+			ParamTypes:  valueTypes(s.Params),
+			ReturnTypes: valueTypes(s.Results),
 		}
 		m.Types.Entries = append(m.Types.Entries, sig)
 
 		fun := wasm.Function{
-			Sig: &sig,
-			Host: reflect.ValueOf(func(proc *exec.Process, sp int32) {
-				p := (*process)(unsafe.Pointer(proc))
-				r.CallMethod("go", method, p.vm, int64(sp))
-			}),
+			Sig:  &sig,
+			Host: hostFunc(r, name, field, s),
 			Body: &wasm.FunctionBody{},
 		}
 		m.FunctionIndexSpace = append(m.FunctionIndexSpace, fun)
 
-		m.Export.Entries[method] = wasm.ExportEntry{
-			FieldStr: method,
+		m.Export.Entries[field] = wasm.ExportEntry{
+			FieldStr: field,
 			Kind:     wasm.ExternalFunction,
 			Index:    uint32(i),
 		}
 	}
 	return m
 }
+
+func valueTypes(types []gowasm.ValueType) []wasm.ValueType {
+	var vts []wasm.ValueType
+	for _, t := range types {
+		switch t {
+		case gowasm.I32:
+			vts = append(vts, wasm.ValueTypeI32)
+		case gowasm.I64:
+			vts = append(vts, wasm.ValueTypeI64)
+		case gowasm.F32:
+			vts = append(vts, wasm.ValueTypeF32)
+		case gowasm.F64:
+			vts = append(vts, wasm.ValueTypeF64)
+		}
+	}
+	return vts
+}
+
+var (
+	processType = reflect.TypeOf((*exec.Process)(nil))
+	rawType     = reflect.TypeOf(uint64(0))
+)
+
+// hostFunc returns the wagon host function calling module.field. wagon
+// passes the arguments of types uint64 as raw wasm values.
+func hostFunc(r *gowasm.Resolver, module, field string, s gowasm.Signature) reflect.Value {
+	if s.Frame {
+		return reflect.ValueOf(func(proc *exec.Process, sp int32) {
+			p := (*process)(unsafe.Pointer(proc))
+			r.CallMethod(module, field, p.vm, int64(sp))
+		})
+	}
+	in := []reflect.Type{processType}
+	for range s.Params {
+		in = append(in, rawType)
+	}
+	var out []reflect.Type
+	for range s.Results {
+		out = append(out, rawType)
+	}
+	t := reflect.FuncOf(in, out, false)
+	return reflect.MakeFunc(t, func(vals []reflect.Value) []reflect.Value {
+		p := (*process)(unsafe.Pointer(vals[0].Interface().(*exec.Process)))
+		args := make([]int64, len(vals)-1)
+		for i, v := range vals[1:] {
+			args[i] = int64(v.Uint())
+		}
+		ret := r.CallFunc(module, field, p.vm, args)
+		if len(out) == 0 {
+			return nil
+		}
+		return []reflect.Value{reflect.ValueOf(uint64(ret))}
+	})
+}
@@ -1,93 +1,377 @@
 package gowasm
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
 	"unsafe"
 )
 
+var (
+	errShortFrame  = errors.New("gowasm: arguments past the end of memory")
+	errResultFrame = errors.New("gowasm: results past the end of memory")
+	errHostMemory  = errors.New("gowasm: result data is not in the guest memory")
+)
+
+// The arguments of a host function are laid out on the guest stack by the
+// Go compiler like the fields of a struct starting at sp+8: each one is
+// aligned to the alignment of its type. The results follow, starting at
+// the next 8 byte boundary.
+
+// wasmLayout returns the size and alignment in the guest memory of the
+// values of type t, false if they can't be passed to or returned by a
+// host function
+func wasmLayout(t reflect.Type) (size, align int64, ok bool) {
+	switch t.Kind() {
+	case reflect.String:
+		return 16, 8, true
+	case reflect.Slice:
+		elem, _, ok := scalarLayout(t.Elem())
+		// slices alias the guest memory, elements must have the same
+		// size for the host and the guest
+		if !ok || elem != int64(t.Elem().Size()) {
+			return 0, 0, false
+		}
+		return 24, 8, true
+	}
+	return scalarLayout(t)
+}
+
+func scalarLayout(t reflect.Type) (size, align int64, ok bool) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1, 1, true
+	case reflect.Int16, reflect.Uint16:
+		return 2, 2, true
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4, 4, true
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uintptr, reflect.Float64:
+		return 8, 8, true
+	}
+	return 0, 0, false
+}
+
+// checkSignature reports an error if the function type t can't be called
+// by the guest
+func checkSignature(t reflect.Type) error {
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("%s is not a function", t)
+	}
+	if t.IsVariadic() {
+		return fmt.Errorf("variadic function %s", t)
+	}
+	for i := 0; i < t.NumIn(); i++ {
+		if _, _, ok := wasmLayout(t.In(i)); !ok {
+			return fmt.Errorf("unsupported parameter type %s", t.In(i))
+		}
+	}
+	for i := 0; i < t.NumOut(); i++ {
+		// a string result would point to the host memory, as the strings
+		// of the host can't be built in the guest memory
+		if _, _, ok := wasmLayout(t.Out(i)); !ok || t.Out(i).Kind() == reflect.String {
+			return fmt.Errorf("unsupported result type %s", t.Out(i))
+		}
+	}
+	return nil
+}
+
+func alignUp(off, align int64) int64 {
+	return (off + align - 1) &^ (align - 1)
+}
+
+// Decoder reads the arguments of a host function from the guest memory.
+// Reading past the memory fails, Err reports the first failure and the
+// values read are zero from then on.
 type Decoder struct {
 	mem []byte
-	buf *bytes.Buffer
+	off int64
+	err error
+
+	// copy makes slices copies of the memory, crossed records them for
+	// WriteBack
+	copy    bool
+	crossed []crossing
+}
+
+// crossing is a copy of the guest memory at ptr
+type crossing struct {
+	ptr int64
+	buf []byte
 }
 
 func NewDecoder(mem []byte, offset int64) *Decoder {
-	return &Decoder{
+	r := &Decoder{
 		mem: mem,
-		buf: bytes.NewBuffer(mem[offset:]),
+		off: offset,
+	}
+	if offset < 0 || offset > int64(len(mem)) {
+		r.err = errShortFrame
+	}
+	return r
+}
+
+// CopySlices makes the Decoder decode slices as copies of the guest memory
+// instead of views aliasing it. The copies can be kept by the host, and
+// WriteBack copies them back to the memory.
+func (r *Decoder) CopySlices() {
+	r.copy = true
+}
+
+// WriteBack copies the slices decoded by a copying Decoder back to mem,
+// which should be the current memory of the guest
+func (r *Decoder) WriteBack(mem []byte) {
+	for _, c := range r.crossed {
+		if c.ptr <= int64(len(mem)) {
+			copy(mem[c.ptr:], c.buf)
+		}
+	}
+}
+
+// Err returns the first error met by the Decoder
+func (r *Decoder) Err() error {
+	return r.err
+}
+
+// field returns the next size bytes of the frame, aligned to align
+func (r *Decoder) field(size, align int64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	off := alignUp(r.off, align)
+	if off > int64(len(r.mem))-size {
+		r.err = errShortFrame
+		return nil
+	}
+	r.off = off + size
+	return r.mem[off : off+size]
+}
+
+// span checks that n elements of size bytes at ptr are in memory
+func (r *Decoder) span(ptr, n, size int64) bool {
+	if r.err != nil {
+		return false
+	}
+	if ptr < 0 || n < 0 || ptr > int64(len(r.mem)) || n > (int64(len(r.mem))-ptr)/size {
+		r.err = ErrOutOfBounds
+		return false
 	}
+	return true
 }
 
-func (r *Decoder) readSlice(v reflect.Value, t reflect.Type) {
-	var ptr, len, cap int64
-	binary.Read(r.buf, binary.LittleEndian, &ptr)
-	binary.Read(r.buf, binary.LittleEndian, &len)
-	binary.Read(r.buf, binary.LittleEndian, &cap)
+func (r *Decoder) readSlice(v reflect.Value, t reflect.Type, b []byte) {
+	ptr := int64(binary.LittleEndian.Uint64(b))
+	len := int64(binary.LittleEndian.Uint64(b[8:]))
+	cap := int64(binary.LittleEndian.Uint64(b[16:]))
+	if cap < len {
+		cap = len
+	}
+	size := int64(t.Elem().Size())
+	if !r.span(ptr, cap, size) {
+		return
+	}
+	mem := r.mem[ptr : ptr+cap*size]
+	if r.copy {
+		mem = append([]byte(nil), mem...)
+		r.crossed = append(r.crossed, crossing{ptr: ptr, buf: mem})
+	}
 	if t.Elem().Kind() == reflect.Uint8 {
-		v.SetBytes(r.mem[ptr : ptr+len])
+		v.SetBytes(mem[:len:cap])
+		return
+	}
+	if len == 0 {
 		return
 	}
 	s := (*reflect.SliceHeader)(unsafe.Pointer(v.Addr().Pointer()))
-	s.Data = uintptr(unsafe.Pointer(&r.mem[ptr]))
+	s.Data = uintptr(unsafe.Pointer(&mem[0]))
 	s.Len = int(len)
 	s.Cap = int(cap)
-	// v.Set(reflect.MakeSlice(t, int(len), int(cap)))
-	// buf := bytes.NewBuffer(r.mem[ptr:])
-	// for i := 0; i < int(len); i++ {
-	// 	elem := v.Index(i)
-	// 	binary.Read(buf, binary.LittleEndian, elem.Addr().Interface())
-	// }
-}
-
-func (r *Decoder) readString() string {
-	var ptr, len int64
-	binary.Read(r.buf, binary.LittleEndian, &ptr)
-	binary.Read(r.buf, binary.LittleEndian, &len)
+}
+
+func (r *Decoder) readString(b []byte) string {
+	ptr := int64(binary.LittleEndian.Uint64(b))
+	len := int64(binary.LittleEndian.Uint64(b[8:]))
+	if !r.span(ptr, len, 1) {
+		return ""
+	}
 	return string(r.mem[ptr : ptr+len])
 }
 
 func (r *Decoder) Decode(ref reflect.Value) {
 	elem := ref.Elem()
 	tp := elem.Type()
+	size, align, ok := wasmLayout(tp)
+	if !ok {
+		panic("bad arg type:" + tp.String())
+	}
+	b := r.field(size, align)
+	if b == nil {
+		return
+	}
 	switch tp.Kind() {
 	case reflect.String:
-		elem.SetString(r.readString())
+		elem.SetString(r.readString(b))
 	case reflect.Slice:
-		r.readSlice(elem, tp)
-	case reflect.Int32, reflect.Int64, reflect.Float64:
-		binary.Read(r.buf, binary.LittleEndian, ref.Interface())
+		r.readSlice(elem, tp, b)
 	default:
-		panic("bad arg type:" + tp.String())
+		getScalar(elem, b)
 	}
 }
 
+// Offset returns the offset in memory following the arguments read
 func (r *Decoder) Offset() int64 {
-	return int64(len(r.mem) - r.buf.Len())
+	return r.off
+}
+
+// getScalar sets v to the little endian value b
+func getScalar(v reflect.Value, b []byte) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(b[0] != 0)
+	case reflect.Int8:
+		v.SetInt(int64(int8(b[0])))
+	case reflect.Int16:
+		v.SetInt(int64(int16(binary.LittleEndian.Uint16(b))))
+	case reflect.Int32:
+		v.SetInt(int64(int32(binary.LittleEndian.Uint32(b))))
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(binary.LittleEndian.Uint64(b)))
+	case reflect.Uint8:
+		v.SetUint(uint64(b[0]))
+	case reflect.Uint16:
+		v.SetUint(uint64(binary.LittleEndian.Uint16(b)))
+	case reflect.Uint32:
+		v.SetUint(uint64(binary.LittleEndian.Uint32(b)))
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(binary.LittleEndian.Uint64(b))
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+}
+
+// putScalar writes the value v little endian to b
+func putScalar(b []byte, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		b[0] = 0
+		if v.Bool() {
+			b[0] = 1
+		}
+	case reflect.Int8:
+		b[0] = byte(v.Int())
+	case reflect.Int16:
+		binary.LittleEndian.PutUint16(b, uint16(v.Int()))
+	case reflect.Int32:
+		binary.LittleEndian.PutUint32(b, uint32(v.Int()))
+	case reflect.Int, reflect.Int64:
+		binary.LittleEndian.PutUint64(b, uint64(v.Int()))
+	case reflect.Uint8:
+		b[0] = byte(v.Uint())
+	case reflect.Uint16:
+		binary.LittleEndian.PutUint16(b, uint16(v.Uint()))
+	case reflect.Uint32:
+		binary.LittleEndian.PutUint32(b, uint32(v.Uint()))
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		binary.LittleEndian.PutUint64(b, v.Uint())
+	case reflect.Float32:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(v.Float()))
+	}
 }
 
+// Encoder writes the results of a host function to the guest memory.
+// Strings and slices are returned as pointers, their data must be in
+// the guest memory. Err reports the first failure.
 type Encoder struct {
-	buf *bytes.Buffer
+	mem []byte
+	off int64
+	err error
+
+	// crossed are the copies of the memory made by the Decoder, returned
+	// slices of them are returned at their address in memory
+	crossed []crossing
 }
 
+// NewEncoder returns an Encoder writing results after the arguments
+// ending at offset of mem
 func NewEncoder(mem []byte, offset int64) *Encoder {
 	return &Encoder{
-		buf: bytes.NewBuffer(mem[offset:offset]),
+		mem: mem,
+		off: alignUp(offset, 8),
 	}
 }
 
+// Err returns the first error met by the Encoder
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+func (e *Encoder) field(size, align int64) []byte {
+	if e.err != nil {
+		return nil
+	}
+	off := alignUp(e.off, align)
+	if off < 0 || off > int64(len(e.mem))-size {
+		e.err = errResultFrame
+		return nil
+	}
+	e.off = off + size
+	return e.mem[off : off+size]
+}
+
+// addr returns the address in the guest memory of the n bytes at p
+func (e *Encoder) addr(p uintptr, n int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	for _, c := range e.crossed {
+		if len(c.buf) == 0 {
+			continue
+		}
+		base := uintptr(unsafe.Pointer(&c.buf[0]))
+		if p >= base && int64(p-base) <= int64(len(c.buf))-n {
+			return c.ptr + int64(p-base)
+		}
+	}
+	if len(e.mem) == 0 {
+		e.err = errHostMemory
+		return 0
+	}
+	base := uintptr(unsafe.Pointer(&e.mem[0]))
+	if p < base || int64(p-base) > int64(len(e.mem))-n {
+		e.err = errHostMemory
+		return 0
+	}
+	return int64(p - base)
+}
+
 func (e *Encoder) Encode(v reflect.Value) {
 	t := v.Type()
+	size, align, ok := wasmLayout(t)
+	if !ok {
+		panic("bad return type:" + t.String())
+	}
+	b := e.field(size, align)
+	if b == nil {
+		return
+	}
 	switch t.Kind() {
-	case reflect.Bool:
-		vv := uint8(0)
-		if v.Bool() {
-			vv = 1
-		}
-		binary.Write(e.buf, binary.LittleEndian, vv)
-	case reflect.Int32, reflect.Int64, reflect.Float64:
-		binary.Write(e.buf, binary.LittleEndian, v.Interface())
+	case reflect.String:
+		s := v.String()
+		p := (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+		binary.LittleEndian.PutUint64(b, uint64(e.addr(p, int64(len(s)))))
+		binary.LittleEndian.PutUint64(b[8:], uint64(len(s)))
+	case reflect.Slice:
+		elem := int64(t.Elem().Size())
+		ptr := e.addr(v.Pointer(), int64(v.Cap())*elem)
+		binary.LittleEndian.PutUint64(b, uint64(ptr))
+		binary.LittleEndian.PutUint64(b[8:], uint64(v.Len()))
+		binary.LittleEndian.PutUint64(b[16:], uint64(v.Cap()))
 	default:
-		panic("bad return type:" + t.String())
+		putScalar(b, v)
 	}
 }
@@ -0,0 +1,72 @@
+package gowasm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Env builds the environment of a guest. It starts empty: the variables
+// of the host are only passed to the guest when allowed by name, so that
+// an untrusted guest doesn't see the secrets they may hold.
+type Env struct {
+	vars map[string]string
+}
+
+func NewEnv() *Env {
+	return &Env{
+		vars: make(map[string]string),
+	}
+}
+
+// Set sets the variable key to value
+func (e *Env) Set(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\x00") {
+		return fmt.Errorf("gowasm: invalid environment variable name %q", key)
+	}
+	if strings.IndexByte(value, 0) >= 0 {
+		return fmt.Errorf("gowasm: environment variable %s contains a NUL byte", key)
+	}
+	e.vars[key] = value
+	return nil
+}
+
+// Parse sets the variable of a KEY=VAL string
+func (e *Env) Parse(kv string) error {
+	i := strings.IndexByte(kv, '=')
+	if i < 0 {
+		return fmt.Errorf("gowasm: environment variable %q is not KEY=VAL", kv)
+	}
+	return e.Set(kv[:i], kv[i+1:])
+}
+
+// Allow passes the variables keys of the host to the guest, the ones not
+// set on the host are skipped. The variables set before are replaced.
+func (e *Env) Allow(keys ...string) error {
+	for _, key := range keys {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := e.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Environ returns the variables as KEY=VAL strings sorted by key, as
+// wasm_exec.js passes them
+func (e *Env) Environ() []string {
+	keys := make([]string, 0, len(e.vars))
+	for key := range e.vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	envs := make([]string, len(keys))
+	for i, key := range keys {
+		envs[i] = key + "=" + e.vars[key]
+	}
+	return envs
+}
@@ -0,0 +1,471 @@
+package gowasm
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/icexin/gowasm/js"
+)
+
+// CallFrame is the stack frame of a host function call. It reads the
+// arguments and writes the results like the Decoder and the Encoder, but
+// without reflection. Host functions registered with the type
+// func(*CallFrame) decode their frame themselves:
+//
+//	r.Register("env", "add", func(f *gowasm.CallFrame) {
+//		a, b := f.Int64(), f.Int64()
+//		if f.Err() != nil {
+//			return
+//		}
+//		f.SetInt64(a + b)
+//	})
+//
+// Arguments are read in order, then results are written in order.
+// An access outside of the memory is recorded by Err and stops the guest
+// once the host function returns.
+type CallFrame struct {
+	vm  VM
+	mem []byte
+	sp  int64
+	// off is the offset of the next argument, out of the next result,
+	// out is 0 until the first result is written
+	off int64
+	out int64
+	err error
+
+	copy    bool
+	crossed []crossing
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(CallFrame)
+	},
+}
+
+func newFrame(vm VM, sp int64, copy bool) *CallFrame {
+	f := framePool.Get().(*CallFrame)
+	*f = CallFrame{
+		vm:      vm,
+		mem:     vm.Memory(),
+		sp:      sp,
+		off:     sp + 8,
+		copy:    copy,
+		crossed: f.crossed[:0],
+	}
+	if sp < 0 || sp > int64(len(f.mem)) {
+		f.err = errShortFrame
+	}
+	return f
+}
+
+func (f *CallFrame) release() {
+	f.vm, f.mem = nil, nil
+	for i := range f.crossed {
+		f.crossed[i] = crossing{}
+	}
+	framePool.Put(f)
+}
+
+// Err returns the first error met reading or writing the frame
+func (f *CallFrame) Err() error {
+	return f.err
+}
+
+// at returns the size bytes of memory at off
+func (f *CallFrame) at(off, size int64, err error) []byte {
+	if f.err != nil {
+		return nil
+	}
+	if off < 0 || off > int64(len(f.mem))-size {
+		f.err = err
+		return nil
+	}
+	return f.mem[off : off+size]
+}
+
+// arg returns the next argument of size bytes, aligned to size
+func (f *CallFrame) arg(size int64) []byte {
+	f.off = alignUp(f.off, size)
+	b := f.at(f.off, size, errShortFrame)
+	f.off += size
+	return b
+}
+
+// result returns the next result of size bytes, aligned to size
+func (f *CallFrame) result(size int64) []byte {
+	if f.out == 0 {
+		f.startResults(alignUp(f.off, 8))
+	}
+	f.out = alignUp(f.out, size)
+	b := f.at(f.out, size, errResultFrame)
+	f.out += size
+	return b
+}
+
+// startResults refreshes the memory, which may have moved during the call,
+// and writes back the copies of the arguments
+func (f *CallFrame) startResults(out int64) {
+	f.out = out
+	f.mem = f.vm.Memory()
+	for _, c := range f.crossed {
+		if c.ptr <= int64(len(f.mem)) {
+			copy(f.mem[c.ptr:], c.buf)
+		}
+	}
+}
+
+func (f *CallFrame) Bool() bool {
+	b := f.arg(1)
+	return b != nil && b[0] != 0
+}
+
+func (f *CallFrame) Int32() int32 {
+	b := f.arg(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+func (f *CallFrame) Uint32() uint32 {
+	return uint32(f.Int32())
+}
+
+func (f *CallFrame) Int64() int64 {
+	b := f.arg(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (f *CallFrame) Uint64() uint64 {
+	return uint64(f.Int64())
+}
+
+func (f *CallFrame) Float64() float64 {
+	return math.Float64frombits(f.Uint64())
+}
+
+func (f *CallFrame) Ref() js.Ref {
+	return js.Ref(f.Uint64())
+}
+
+// span returns the n elements of size bytes at ptr, a copy if the frame
+// copies slices
+func (f *CallFrame) span(ptr, n, size int64) []byte {
+	if f.err != nil {
+		return nil
+	}
+	if ptr < 0 || n < 0 || ptr > int64(len(f.mem)) || n > (int64(len(f.mem))-ptr)/size {
+		f.err = ErrOutOfBounds
+		return nil
+	}
+	b := f.mem[ptr : ptr+n*size : ptr+n*size]
+	if f.copy && n > 0 {
+		b = append([]byte(nil), b...)
+		f.crossed = append(f.crossed, crossing{ptr: ptr, buf: b})
+	}
+	return b
+}
+
+func (f *CallFrame) Str() string {
+	ptr, n := f.Int64(), f.Int64()
+	return string(f.span(ptr, n, 1))
+}
+
+// Bytes returns a []byte argument, aliasing the memory for the duration
+// of the call unless the Resolver copies slices
+func (f *CallFrame) Bytes() []byte {
+	ptr, n, c := f.Int64(), f.Int64(), f.Int64()
+	if c < n {
+		c = n
+	}
+	b := f.span(ptr, c, 1)
+	if b == nil {
+		return nil
+	}
+	return b[:n:c]
+}
+
+// Refs returns a []js.Ref argument like Bytes
+func (f *CallFrame) Refs() []js.Ref {
+	ptr, n, c := f.Int64(), f.Int64(), f.Int64()
+	if c < n {
+		c = n
+	}
+	b := f.span(ptr, c, 8)
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*js.Ref)(unsafe.Pointer(&b[0])), c)[:n:c]
+}
+
+func (f *CallFrame) SetBool(v bool) {
+	if b := f.result(1); b != nil {
+		b[0] = 0
+		if v {
+			b[0] = 1
+		}
+	}
+}
+
+func (f *CallFrame) SetInt32(v int32) {
+	if b := f.result(4); b != nil {
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	}
+}
+
+func (f *CallFrame) SetInt64(v int64) {
+	if b := f.result(8); b != nil {
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+func (f *CallFrame) SetFloat64(v float64) {
+	f.SetInt64(int64(math.Float64bits(v)))
+}
+
+func (f *CallFrame) SetRef(v js.Ref) {
+	f.SetInt64(int64(v))
+}
+
+// finish ends the call, the copies of the arguments are written back if
+// no result was written
+func (f *CallFrame) finish() {
+	if f.out == 0 && f.err == nil {
+		f.startResults(alignUp(f.off, 8))
+	}
+}
+
+// fastCall returns the call of f through a CallFrame, without reflection,
+// for func(*CallFrame) and the signatures of the runtime imports. It
+// returns nil for the other signatures.
+func fastCall(f interface{}) func(*CallFrame) {
+	switch f := f.(type) {
+	case func(*CallFrame):
+		return f
+	case func():
+		return func(fr *CallFrame) {
+			f()
+		}
+	case func(int32):
+		return func(fr *CallFrame) {
+			a := fr.Int32()
+			if fr.err == nil {
+				f(a)
+			}
+		}
+	case func(int64):
+		return func(fr *CallFrame) {
+			a := fr.Int64()
+			if fr.err == nil {
+				f(a)
+			}
+		}
+	case func() int64:
+		return func(fr *CallFrame) {
+			fr.SetInt64(f())
+		}
+	case func() (int64, int32):
+		return func(fr *CallFrame) {
+			a, b := f()
+			fr.SetInt64(a)
+			fr.SetInt32(b)
+		}
+	case func(int64) int32:
+		return func(fr *CallFrame) {
+			a := fr.Int64()
+			if fr.err == nil {
+				fr.SetInt32(f(a))
+			}
+		}
+	case func(int64, int64, int32):
+		return func(fr *CallFrame) {
+			a, b, c := fr.Int64(), fr.Int64(), fr.Int32()
+			if fr.err == nil {
+				f(a, b, c)
+			}
+		}
+	case func([]byte):
+		return func(fr *CallFrame) {
+			a := fr.Bytes()
+			if fr.err == nil {
+				f(a)
+			}
+		}
+	case func(js.Ref) int64:
+		return func(fr *CallFrame) {
+			a := fr.Ref()
+			if fr.err == nil {
+				fr.SetInt64(f(a))
+			}
+		}
+	case func(js.Ref) (js.Ref, int64):
+		return func(fr *CallFrame) {
+			a := fr.Ref()
+			if fr.err == nil {
+				r, n := f(a)
+				fr.SetRef(r)
+				fr.SetInt64(n)
+			}
+		}
+	case func(js.Ref, []byte):
+		return func(fr *CallFrame) {
+			a, b := fr.Ref(), fr.Bytes()
+			if fr.err == nil {
+				f(a, b)
+			}
+		}
+	case func(string) js.Ref:
+		return func(fr *CallFrame) {
+			a := fr.Str()
+			if fr.err == nil {
+				fr.SetRef(f(a))
+			}
+		}
+	case func(js.Ref, string) js.Ref:
+		return func(fr *CallFrame) {
+			a, b := fr.Ref(), fr.Str()
+			if fr.err == nil {
+				fr.SetRef(f(a, b))
+			}
+		}
+	case func(js.Ref, string, js.Ref):
+		return func(fr *CallFrame) {
+			a, b, c := fr.Ref(), fr.Str(), fr.Ref()
+			if fr.err == nil {
+				f(a, b, c)
+			}
+		}
+	case func(js.Ref, int64) js.Ref:
+		return func(fr *CallFrame) {
+			a, b := fr.Ref(), fr.Int64()
+			if fr.err == nil {
+				fr.SetRef(f(a, b))
+			}
+		}
+	case func(js.Ref, int64, js.Ref):
+		return func(fr *CallFrame) {
+			a, b, c := fr.Ref(), fr.Int64(), fr.Ref()
+			if fr.err == nil {
+				f(a, b, c)
+			}
+		}
+	case func(js.Ref, []js.Ref) (js.Ref, bool):
+		return func(fr *CallFrame) {
+			a, b := fr.Ref(), fr.Refs()
+			if fr.err == nil {
+				r, ok := f(a, b)
+				fr.SetRef(r)
+				fr.SetBool(ok)
+			}
+		}
+	case func(js.Ref, string, []js.Ref) (js.Ref, bool):
+		return func(fr *CallFrame) {
+			a, b, c := fr.Ref(), fr.Str(), fr.Refs()
+			if fr.err == nil {
+				r, ok := f(a, b, c)
+				fr.SetRef(r)
+				fr.SetBool(ok)
+			}
+		}
+	}
+	return nil
+}
+
+// plan is the layout of the frame of a host function called by
+// reflection, computed when it is registered
+type plan struct {
+	in  []slot
+	out []slot
+}
+
+// slot is an argument or result at off from sp
+type slot struct {
+	off  int64
+	size int64
+	t    reflect.Type
+}
+
+func compilePlan(t reflect.Type) *plan {
+	p := new(plan)
+	off := int64(8)
+	for i := 0; i < t.NumIn(); i++ {
+		size, align, _ := wasmLayout(t.In(i))
+		off = alignUp(off, align)
+		p.in = append(p.in, slot{off: off, size: size, t: t.In(i)})
+		off += size
+	}
+	off = alignUp(off, 8)
+	for i := 0; i < t.NumOut(); i++ {
+		size, align, _ := wasmLayout(t.Out(i))
+		off = alignUp(off, align)
+		p.out = append(p.out, slot{off: off, size: size, t: t.Out(i)})
+		off += size
+	}
+	return p
+}
+
+// call calls fn with the arguments of the frame f, args are settable
+// values of the parameter types
+func (p *plan) call(fn reflect.Value, f *CallFrame, args []reflect.Value) {
+	for i, s := range p.in {
+		b := f.at(f.sp+s.off, s.size, errShortFrame)
+		if b == nil {
+			return
+		}
+		v := args[i]
+		switch s.t.Kind() {
+		case reflect.String:
+			v.SetString(string(f.span(int64(binary.LittleEndian.Uint64(b)), int64(binary.LittleEndian.Uint64(b[8:])), 1)))
+		case reflect.Slice:
+			f.setSlice(v, b)
+		default:
+			getScalar(v, b)
+		}
+	}
+	if f.err != nil {
+		return
+	}
+	f.off = f.sp + 8
+	if len(p.in) > 0 {
+		last := p.in[len(p.in)-1]
+		f.off = f.sp + last.off + last.size
+	}
+	rets := fn.Call(args)
+	f.startResults(alignUp(f.off, 8))
+	enc := Encoder{mem: f.mem, crossed: f.crossed}
+	for i, s := range p.out {
+		enc.off = f.sp + s.off
+		enc.Encode(rets[i])
+	}
+	f.err = enc.err
+}
+
+func (f *CallFrame) setSlice(v reflect.Value, b []byte) {
+	ptr := int64(binary.LittleEndian.Uint64(b))
+	n := int64(binary.LittleEndian.Uint64(b[8:]))
+	c := int64(binary.LittleEndian.Uint64(b[16:]))
+	if c < n {
+		c = n
+	}
+	elem := v.Type().Elem()
+	mem := f.span(ptr, c, int64(elem.Size()))
+	if len(mem) == 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	if elem.Kind() == reflect.Uint8 {
+		v.SetBytes(mem[:n:c])
+		return
+	}
+	s := (*reflect.SliceHeader)(unsafe.Pointer(v.Addr().Pointer()))
+	s.Data = uintptr(unsafe.Pointer(&mem[0]))
+	s.Len = int(n)
+	s.Cap = int(c)
+}
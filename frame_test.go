@@ -0,0 +1,101 @@
+package gowasm
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/icexin/gowasm/js"
+)
+
+func TestCompilePlan(t *testing.T) {
+	tests := []struct {
+		f       interface{}
+		in, out []int64
+	}{
+		{f: func(fd int64, p int64, n int32) {}, in: []int64{8, 16, 24}},
+		{f: func(fd int64, p int64, n int32) int64 { return 0 }, in: []int64{8, 16, 24}, out: []int64{32}},
+		{f: func(int32, int64) {}, in: []int64{8, 16}},
+		{f: func(bool, int16, int32, float32) int8 { return 0 }, in: []int64{8, 10, 12, 16}, out: []int64{24}},
+		{f: func(int8, uint16, int8, uint64) {}, in: []int64{8, 10, 12, 16}},
+		{f: func(int8, string) {}, in: []int64{8, 16}},
+		{f: func(js.Ref, []byte) (int64, bool) { return 0, false }, in: []int64{8, 16}, out: []int64{40, 48}},
+		{f: func(int32) (int32, int64) { return 0, 0 }, in: []int64{8}, out: []int64{16, 24}},
+		{f: func(uint8) (bool, float32, float64) { return false, 0, 0 }, in: []int64{8}, out: []int64{16, 20, 24}},
+		{f: func() int32 { return 0 }, out: []int64{8}},
+	}
+	for _, test := range tests {
+		typ := reflect.TypeOf(test.f)
+		if err := checkSignature(typ); err != nil {
+			t.Errorf("%s: %s", typ, err)
+			continue
+		}
+		p := compilePlan(typ)
+		if in := slotOffsets(p.in); !reflect.DeepEqual(in, test.in) {
+			t.Errorf("%s: arguments at %v, want %v", typ, in, test.in)
+		}
+		if out := slotOffsets(p.out); !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%s: results at %v, want %v", typ, out, test.out)
+		}
+	}
+}
+
+func slotOffsets(slots []slot) []int64 {
+	var offs []int64
+	for _, s := range slots {
+		offs = append(offs, s.off)
+	}
+	return offs
+}
+
+func TestCheckSignature(t *testing.T) {
+	tests := []struct {
+		f  interface{}
+		ok bool
+	}{
+		{f: func(string, []byte, []float64) ([]byte, js.Ref) { return nil, 0 }, ok: true},
+		{f: func() string { return "" }},
+		{f: func() (int32, string) { return 0, "" }},
+		{f: func(...int32) {}},
+		{f: func(map[string]int) {}},
+		{f: func([]string) {}},
+		{f: func() []int { return nil }, ok: true},
+		{f: func(complex64) {}},
+		{f: 1},
+	}
+	for _, test := range tests {
+		typ := reflect.TypeOf(test.f)
+		if err := checkSignature(typ); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", typ, err, test.ok)
+		}
+	}
+}
+
+// TestCallPlan calls a host function with a mixed width frame through the
+// Resolver, and checks the arguments it gets and the results it writes
+func TestCallPlan(t *testing.T) {
+	mem := make([]byte, 4096)
+	const sp = 1024
+	frame := mem[sp:]
+	frame[8] = 1
+	binary.LittleEndian.PutUint16(frame[10:], 0xfffe)
+	binary.LittleEndian.PutUint32(frame[12:], 7)
+	binary.LittleEndian.PutUint64(frame[16:], 2048)
+	binary.LittleEndian.PutUint64(frame[24:], 3)
+	copy(mem[2048:], "abc")
+
+	r := NewResolver()
+	r.Register("go", "f", func(b bool, x int16, n uint32, s string) (int8, int64) {
+		if !b || x != -2 || n != 7 || s != "abc" {
+			t.Errorf("got arguments %v %d %d %q", b, x, n, s)
+		}
+		return -1, 1 << 40
+	})
+	r.CallMethod("go", "f", memoryFunc(func() []byte { return mem }), sp)
+	if frame[32] != 0xff {
+		t.Errorf("int8 result %#x, want 0xff", frame[32])
+	}
+	if n := binary.LittleEndian.Uint64(frame[40:]); n != 1<<40 {
+		t.Errorf("int64 result %d, want %d", n, int64(1<<40))
+	}
+}
@@ -1 +1,3 @@
 module github.com/icexin/gowasm
+
+go 1.17
@@ -1,33 +1,93 @@
 package gowasm
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
 )
 
-func PrepareArgs(mem []byte, args []string, envs []string) (int, int) {
-	argc := len(args)
-	offset := 4096
+const (
+	// argsOffset is where wasm_exec.js writes the arguments
+	argsOffset = 4096
+	// argsLimit is the room the go linker leaves for the arguments and
+	// the environment below the data, see wasmMinDataAddr in cmd/link.
+	// wasm_exec.js fails if they reach it.
+	argsLimit = 8192
+)
+
+// ErrArgsTooLong is returned when the arguments and the environment of
+// the guest don't fit below its data
+var ErrArgsTooLong = errors.New("gowasm: total length of the arguments and the environment exceeds 8191 bytes")
+
+// WriteArgs writes args and envs to mem for the run export of the js
+// port, like wasm_exec.js, and returns its argc and argv. It fails
+// without writing anything if a string contains a NUL byte, or if they
+// don't fit in mem or below the data of the guest.
+func WriteArgs(mem []byte, args []string, envs []string) (argc int, argv int, err error) {
+	size := 0
+	for _, strs := range [][]string{args, envs} {
+		for _, s := range strs {
+			if strings.IndexByte(s, 0) >= 0 {
+				return 0, 0, fmt.Errorf("gowasm: %q contains a NUL byte", s)
+			}
+			size += alignArg(len(s) + 1)
+		}
+	}
+	// the pointers of args, the slot read as the number of envs by go1.11,
+	// the pointers of envs and their terminator
+	nptrs := len(args) + 1 + len(envs) + 1
+	size += nptrs * 8
+	if size >= argsLimit {
+		return 0, 0, ErrArgsTooLong
+	}
+	if argsOffset+size > len(mem) {
+		return 0, 0, ErrOutOfBounds
+	}
+
+	offset := argsOffset
 	strdup := func(s string) int {
-		copy(mem[offset:], s+"\x00")
 		ptr := offset
-		offset += len(s) + (8 - len(s)%8)
+		n := copy(mem[offset:], s)
+		end := offset + alignArg(len(s)+1)
+		for i := offset + n; i < end; i++ {
+			mem[i] = 0
+		}
+		offset = end
 		return ptr
 	}
-	var argvAddr []int
+	ptrs := make([]int, 0, nptrs)
 	for _, arg := range args {
-		argvAddr = append(argvAddr, strdup(arg))
+		ptrs = append(ptrs, strdup(arg))
 	}
-
-	argvAddr = append(argvAddr, len(envs))
+	ptrs = append(ptrs, len(envs))
 	for _, env := range envs {
-		argvAddr = append(argvAddr, strdup(env))
+		ptrs = append(ptrs, strdup(env))
+	}
+	ptrs = append(ptrs, 0)
+
+	argv = offset
+	for _, ptr := range ptrs {
+		binary.LittleEndian.PutUint64(mem[offset:], uint64(ptr))
+		offset += 8
 	}
+	return len(args), argv, nil
+}
 
-	argv := offset
-	buf := bytes.NewBuffer(mem[offset:offset])
-	for _, addr := range argvAddr {
-		binary.Write(buf, binary.LittleEndian, int64(addr))
+// alignArg returns n rounded up to the 8 byte alignment of the strings of
+// the arguments
+func alignArg(n int) int {
+	return (n + 7) &^ 7
+}
+
+// PrepareArgs writes args and envs to mem and returns argc and argv, it
+// panics if they can't be written.
+//
+// Deprecated: use WriteArgs, which returns the error.
+func PrepareArgs(mem []byte, args []string, envs []string) (int, int) {
+	argc, argv, err := WriteArgs(mem, args, envs)
+	if err != nil {
+		panic(err)
 	}
 	return argc, argv
 }
@@ -0,0 +1,138 @@
+package gowasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// TestWriteArgs checks the layout against the one of wasm_exec.js: the
+// NUL terminated strings from 4096, each padded to 8 bytes, then the
+// 64-bit pointers of the args, the slot of the number of envs, the
+// pointers of the envs and their terminator.
+func TestWriteArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		envs  []string
+		mem   int
+		strs  []string // the strings from argsOffset, padding included
+		ptrs  []uint64
+		err   error
+		noNUL bool
+	}{
+		{
+			name: "unaligned",
+			args: []string{"a"},
+			mem:  wasmPageSize,
+			strs: []string{"a\x00\x00\x00\x00\x00\x00\x00"},
+			ptrs: []uint64{4096, 0, 0},
+		},
+		{
+			name: "aligned",
+			args: []string{"abcdefg", "abcdefgh"},
+			mem:  wasmPageSize,
+			strs: []string{"abcdefg\x00", "abcdefgh\x00\x00\x00\x00\x00\x00\x00\x00"},
+			ptrs: []uint64{4096, 4104, 0, 0},
+		},
+		{
+			name: "envs",
+			args: []string{"prog"},
+			envs: []string{"A=1", "HOME=/"},
+			mem:  wasmPageSize,
+			strs: []string{"prog\x00\x00\x00\x00", "A=1\x00\x00\x00\x00\x00", "HOME=/\x00\x00"},
+			ptrs: []uint64{4096, 2, 4104, 4112, 0},
+		},
+		{
+			name: "empty",
+			mem:  wasmPageSize,
+			ptrs: []uint64{0, 0},
+		},
+		{
+			name:  "NUL arg",
+			args:  []string{"a\x00b"},
+			mem:   wasmPageSize,
+			noNUL: true,
+		},
+		{
+			name:  "NUL env",
+			args:  []string{"prog"},
+			envs:  []string{"A=\x00"},
+			mem:   wasmPageSize,
+			noNUL: true,
+		},
+		{
+			// 8160 bytes of string and 3 pointers
+			name: "below the limit",
+			args: []string{strings.Repeat("x", 8159)},
+			mem:  wasmPageSize,
+			strs: []string{strings.Repeat("x", 8159) + "\x00"},
+			ptrs: []uint64{4096, 0, 0},
+		},
+		{
+			// 8168 bytes of string and 3 pointers, wasm_exec.js fails
+			// when the end reaches wasmMinDataAddr
+			name: "limit",
+			args: []string{strings.Repeat("x", 8167)},
+			mem:  wasmPageSize,
+			err:  ErrArgsTooLong,
+		},
+		{
+			name: "fits in memory",
+			args: []string{"a"},
+			mem:  argsOffset + 8 + 3*8,
+			strs: []string{"a\x00\x00\x00\x00\x00\x00\x00"},
+			ptrs: []uint64{4096, 0, 0},
+		},
+		{
+			name: "short memory",
+			args: []string{"a"},
+			mem:  argsOffset + 8 + 3*8 - 1,
+			err:  ErrOutOfBounds,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := bytes.Repeat([]byte{0xff}, test.mem)
+			argc, argv, err := WriteArgs(mem, test.args, test.envs)
+			if test.noNUL || test.err != nil {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if test.err != nil && err != test.err {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				if test.noNUL && !strings.Contains(err.Error(), "NUL") {
+					t.Fatalf("error %v, want a NUL byte error", err)
+				}
+				if bytes.IndexByte(mem, 0) >= 0 {
+					t.Fatal("the memory was written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if argc != len(test.args) {
+				t.Errorf("argc %d, want %d", argc, len(test.args))
+			}
+			strs := strings.Join(test.strs, "")
+			if want := argsOffset + len(strs); argv != want {
+				t.Fatalf("argv %d, want %d", argv, want)
+			}
+			if got := string(mem[argsOffset:argv]); got != strs {
+				t.Errorf("strings %q, want %q", got, strs)
+			}
+			for i, want := range test.ptrs {
+				if got := binary.LittleEndian.Uint64(mem[argv+i*8:]); got != want {
+					t.Errorf("pointer %d is %d, want %d", i, got, want)
+				}
+			}
+			end := argv + len(test.ptrs)*8
+			if mem[argsOffset-1] != 0xff || (end < len(mem) && mem[end] != 0xff) {
+				t.Error("written outside of the arguments")
+			}
+		})
+	}
+}
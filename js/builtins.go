@@ -1,10 +1,13 @@
 package js
 
+import "math"
+
 var (
 	ErrNotfound        = NewException("EEXIS", "not found")
 	ErrNoSys           = NewException("ENOSYS", "not implemention")
 	ErrInvalidArgument = NewException("EINVAL", "invalid argument")
 	ErrUndefined       = NewException("EINVAL", "undefined")
+	ErrNotFunction     = NewException("EINVAL", "not a function")
 )
 
 type Exception struct {
@@ -23,29 +26,47 @@ func (e *Exception) Error() string {
 	return e.Message
 }
 
-func Array() []interface{} {
-	return []interface{}{}
-}
-
-func Uint8Array(b []byte, offset int64, len int64) []byte {
-	return b[offset : offset+len]
-}
-
-type Memory struct {
-	memfunc func() []byte
-}
-
-func NewMemory(f func() []byte) *Memory {
-	return &Memory{
-		memfunc: f,
+// Array implements new Array(n), used by the guest to build arrays,
+// and new Array(elems...)
+func Array(args ...*Value) []interface{} {
+	if len(args) == 1 {
+		if n, ok := args[0].Interface().(int64); ok && n >= 0 {
+			return make([]interface{}, n)
+		}
 	}
+	elems := make([]interface{}, len(args))
+	for i, arg := range args {
+		elems[i] = arg
+	}
+	return elems
 }
 
-func (m *Memory) Get(name string) (interface{}, bool) {
-	return m.memfunc(), true
+// Uint8Array implements new Uint8Array(buffer, offset, len) and
+// new Uint8Array(len). A view of the wasm memory buffer is a *MemoryView,
+// which follows the memory when the guest grows it.
+func Uint8Array(buf interface{}, offset int64, len int64) (interface{}, error) {
+	switch b := buf.(type) {
+	case float64:
+		if b < 0 || b != math.Trunc(b) || b > math.MaxInt32 {
+			return nil, ErrInvalidArgument
+		}
+		return make([]byte, int(b)), nil
+	case *Memory:
+		if offset < 0 || len < 0 {
+			return nil, ErrInvalidArgument
+		}
+		return &MemoryView{mem: b, offset: offset, len: len}, nil
+	case []byte:
+		if offset < 0 || len < 0 || offset > int64(cap(b)) || len > int64(cap(b))-offset {
+			return nil, ErrInvalidArgument
+		}
+		return b[offset : offset+len], nil
+	}
+	return nil, ErrInvalidArgument
 }
 
 func RegisterBuiltins(g *Global) {
+	g.Register("Object", NewObject)
 	g.Register("Array", Array)
 	g.Register("Uint8Array", Uint8Array)
 }
@@ -0,0 +1,215 @@
+package js
+
+import (
+	"math"
+	"reflect"
+)
+
+var (
+	refType   = reflect.TypeOf(Ref(0))
+	valueType = reflect.TypeOf((*Value)(nil))
+)
+
+// convertArgs converts args to the parameter types of the function type ft.
+// Missing arguments get zero values, extra arguments are dropped unless ft
+// is variadic. A value that can't be converted yields ErrInvalidArgument.
+func (vm *VM) convertArgs(ft reflect.Type, args []Ref) ([]reflect.Value, error) {
+	n := ft.NumIn()
+	if ft.IsVariadic() {
+		n--
+	}
+	var in []reflect.Value
+	for i := 0; i < n; i++ {
+		t := ft.In(i)
+		arg := ValueUndefined
+		if i < len(args) {
+			arg = args[i]
+		}
+		v, err := vm.convert(arg, t)
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, v)
+	}
+	if ft.IsVariadic() {
+		t := ft.In(n).Elem()
+		for i := n; i < len(args); i++ {
+			v, err := vm.convert(args[i], t)
+			if err != nil {
+				return nil, err
+			}
+			in = append(in, v)
+		}
+	}
+	return in, nil
+}
+
+// convert converts the js value ref to a Go value of type t
+func (vm *VM) convert(ref Ref, t reflect.Type) (reflect.Value, error) {
+	switch t {
+	case refType:
+		return reflect.ValueOf(ref), nil
+	case callbackType:
+		var f *Func
+		if v, ok := vm.values[ref]; ok {
+			f, _ = v.value.Interface().(*Func)
+		}
+		if f == nil && ref != ValueUndefined && ref != ValueNull {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		return reflect.ValueOf(vm.nodeCallback(f)), nil
+	case valueType:
+		v, ok := vm.loadValue(ref)
+		if !ok {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		return reflect.ValueOf(v), nil
+	}
+
+	switch ref {
+	case ValueUndefined, ValueNull:
+		return reflect.Zero(t), nil
+	case ValueTrue, ValueFalse:
+		return vm.convertValue(reflect.ValueOf(ref == ValueTrue), t)
+	}
+
+	if f, ok := ref.Float(); ok {
+		return convertNumber(f, t)
+	}
+	if ref == ValueNaN {
+		return convertNumber(math.NaN(), t)
+	}
+	v, ok := vm.values[ref]
+	if !ok {
+		return reflect.Value{}, ErrInvalidArgument
+	}
+	return vm.convertValue(v.value, t)
+}
+
+func convertNumber(f float64, t reflect.Type) (reflect.Value, error) {
+	ret := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || ret.OverflowInt(int64(f)) {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		ret.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || ret.OverflowUint(uint64(f)) {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		ret.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		ret.SetFloat(f)
+	case reflect.Interface:
+		if !reflect.TypeOf(f).Implements(t) {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		ret.Set(reflect.ValueOf(f))
+	default:
+		return reflect.Value{}, ErrInvalidArgument
+	}
+	return ret, nil
+}
+
+// convertValue converts the stored Go value v to type t
+func (vm *VM) convertValue(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	if v.Type() == valueType && t != valueType {
+		if v.IsNil() {
+			return reflect.Zero(t), nil
+		}
+		return vm.convertValue(v.Interface().(*Value).value, t)
+	}
+	if bv, ok := v.Interface().(bytesView); ok && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		// resolved on every call, the memory may have grown since the
+		// view was created
+		return reflect.ValueOf(bv.Bytes()).Convert(t), nil
+	}
+	vt := v.Type()
+	switch {
+	case vt.AssignableTo(t):
+		ret := reflect.New(t).Elem()
+		ret.Set(v)
+		return ret, nil
+	case vt.Kind() == reflect.Ptr && vt.Elem().AssignableTo(t):
+		if v.IsNil() {
+			return reflect.Zero(t), nil
+		}
+		return vm.convertValue(v.Elem(), t)
+	case vt.Kind() == reflect.Interface:
+		return vm.convertValue(v.Elem(), t)
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		switch vt.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return convertNumber(float64(v.Int()), t)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return convertNumber(float64(v.Uint()), t)
+		case reflect.Float32, reflect.Float64:
+			return convertNumber(v.Float(), t)
+		}
+	case reflect.String, reflect.Bool:
+		if vt.Kind() == t.Kind() {
+			return v.Convert(t), nil
+		}
+	case reflect.Slice:
+		if vt.Kind() == reflect.Slice || vt.Kind() == reflect.Array {
+			ret := reflect.MakeSlice(t, v.Len(), v.Len())
+			for i := 0; i < v.Len(); i++ {
+				elem, err := vm.convertValue(v.Index(i), t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				ret.Index(i).Set(elem)
+			}
+			return ret, nil
+		}
+	case reflect.Struct:
+		if vt.Kind() == reflect.Map && vt.Key().Kind() == reflect.String {
+			return vm.convertMap(v, t)
+		}
+	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Struct {
+			elem, err := vm.convertValue(v, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			ret := reflect.New(t.Elem())
+			ret.Elem().Set(elem)
+			return ret, nil
+		}
+	}
+	return reflect.Value{}, ErrInvalidArgument
+}
+
+// convertMap fills a struct of type t from the js object m,
+// matching the keys with the js names of the fields
+func (vm *VM) convertMap(m reflect.Value, t reflect.Type) (reflect.Value, error) {
+	ret := reflect.New(t).Elem()
+	for name, mb := range vm.members(t) {
+		if mb.method >= 0 {
+			continue
+		}
+		v := m.MapIndex(reflect.ValueOf(name).Convert(m.Type().Key()))
+		if !v.IsValid() {
+			continue
+		}
+		f, err := ret.FieldByIndexErr(mb.field)
+		if err != nil {
+			return reflect.Value{}, ErrInvalidArgument
+		}
+		fv, err := vm.convertValue(v, f.Type())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		f.Set(fv)
+	}
+	return ret, nil
+}
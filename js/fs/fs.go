@@ -2,48 +2,51 @@ package fs
 
 import (
 	"os"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/icexin/gowasm/js"
 )
 
-var (
-	Sandbox = true
-)
-
+// Constants are the flags of OpenSync, named for js as in node's fs.constants
 type Constants struct {
-	O_WRONLY int
-	O_RDWR   int
-	O_CREAT  int
-	O_TRUNC  int
-	O_APPEND int
-	O_EXCL   int
+	WriteOnly int `js:"O_WRONLY"`
+	ReadWrite int `js:"O_RDWR"`
+	Create    int `js:"O_CREAT"`
+	Truncate  int `js:"O_TRUNC"`
+	Append    int `js:"O_APPEND"`
+	Exclusive int `js:"O_EXCL"`
 }
 
 func NewConstants() *Constants {
 	return &Constants{
-		O_WRONLY: os.O_WRONLY,
-		O_RDWR:   os.O_RDWR,
-		O_CREAT:  os.O_CREATE,
-		O_TRUNC:  os.O_TRUNC,
-		O_APPEND: os.O_APPEND,
-		O_EXCL:   os.O_EXCL,
+		WriteOnly: os.O_WRONLY,
+		ReadWrite: os.O_RDWR,
+		Create:    os.O_CREATE,
+		Truncate:  os.O_TRUNC,
+		Append:    os.O_APPEND,
+		Exclusive: os.O_EXCL,
 	}
-
 }
 
 type FS struct {
 	Constants *Constants
+	// Sandbox denies opening files, it is true for a new FS
+	Sandbox bool `js:"-"`
+
+	nread    uint64
+	nwritten uint64
 }
 
 func NewFS() *FS {
 	return &FS{
 		Constants: NewConstants(),
+		Sandbox:   true,
 	}
 }
 
 func (f *FS) OpenSync(path string, flag, mode int64) (int, error) {
-	if Sandbox {
+	if f.Sandbox {
 		return 0, js.ErrNoSys
 	}
 	return syscall.Open(path, int(flag), uint32(mode))
@@ -63,18 +66,48 @@ func (f *FS) FstatSync(fd int64) (*Stat, error) {
 	return &stat, err
 }
 
+// span returns the len bytes of b at offset
+func span(b []byte, offset, len int64) ([]byte, error) {
+	if offset < 0 || len < 0 || offset > int64(cap(b)) || len > int64(cap(b))-offset {
+		return nil, js.ErrInvalidArgument
+	}
+	return b[offset : offset+len], nil
+}
+
 func (f *FS) WriteSync(fd int64, b []byte, offset, len int64) (int, error) {
-	return syscall.Write(int(fd), b[offset:offset+len])
+	p, err := span(b, offset, len)
+	if err != nil {
+		return 0, err
+	}
+	n, err := syscall.Write(int(fd), p)
+	if n > 0 {
+		atomic.AddUint64(&f.nwritten, uint64(n))
+	}
+	return n, err
 }
 
 func (f *FS) ReadSync(fd int64, b []byte, offset, len int64) (int, error) {
-	return syscall.Read(int(fd), b[offset:offset+len])
+	p, err := span(b, offset, len)
+	if err != nil {
+		return 0, err
+	}
+	n, err := syscall.Read(int(fd), p)
+	if n > 0 {
+		atomic.AddUint64(&f.nread, uint64(n))
+	}
+	return n, err
 }
 
-func (f *FS) CloseSync(fd int64) error {
-	return syscall.Close(int(fd))
+// BytesRead returns the number of bytes read by ReadSync
+func (f *FS) BytesRead() uint64 {
+	return atomic.LoadUint64(&f.nread)
 }
 
-func init() {
-	js.Register("Fs", NewFS())
+// BytesWritten returns the number of bytes written by WriteSync
+func (f *FS) BytesWritten() uint64 {
+	return atomic.LoadUint64(&f.nwritten)
+}
+
+func (f *FS) CloseSync(fd int64) error {
+	return syscall.Close(int(fd))
 }
@@ -0,0 +1,66 @@
+package js
+
+// Func is a guest function wrapped by Go._makeFuncWrapper, the js side of
+// a function created by js.FuncOf in the guest
+type Func struct {
+	ID int64
+}
+
+// FuncInvoker calls the guest function f with this and args and returns
+// its result. It is provided by the runtime driving the guest.
+type FuncInvoker func(f *Func, this Ref, args []Ref) (Ref, error)
+
+// Go is the js instance of the Go class. The guest runtime wraps its
+// functions with _makeFuncWrapper, and reads the call to handle from
+// _pendingEvent when it is resumed.
+type Go struct {
+	pendingEvent *Value
+}
+
+func (g *Go) Get(name string) (interface{}, bool) {
+	switch name {
+	case "_pendingEvent":
+		return g.pendingEvent, true
+	case "_makeFuncWrapper":
+		return g.makeFuncWrapper, true
+	}
+	return nil, false
+}
+
+func (g *Go) Set(name string, value interface{}) {
+	if name != "_pendingEvent" {
+		return
+	}
+	if v, ok := value.(*Value); ok {
+		g.pendingEvent = v
+	}
+}
+
+func (g *Go) makeFuncWrapper(id int64) *Func {
+	return &Func{ID: id}
+}
+
+// SetPendingEvent makes the call of f the event handled by the guest
+// when it is resumed, and returns the event object
+func (vm *VM) SetPendingEvent(f *Func, this Ref, args []Ref) Object {
+	argv := make([]interface{}, len(args))
+	for i, arg := range args {
+		argv[i] = vm.valueOf(arg)
+	}
+	ev := Object{
+		"id":   f.ID,
+		"this": vm.valueOf(this),
+		"args": argv,
+	}
+	ref := vm.storeValue("event", ev)
+	vm.goobj.pendingEvent = vm.values[ref]
+	return ev
+}
+
+// EventResult returns the result the guest set on the event ev
+func (vm *VM) EventResult(ev Object) Ref {
+	if v, ok := ev["result"].(*Value); ok {
+		return v.ref
+	}
+	return ValueUndefined
+}
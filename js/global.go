@@ -1,7 +1,5 @@
 package js
 
-var DefaultGlobal = NewGlobal()
-
 type Global struct {
 	properties map[string]interface{}
 }
@@ -16,11 +14,12 @@ func (g *Global) Register(name string, prop interface{}) {
 	g.properties[name] = prop
 }
 
+// Set implements Setter, the guest sets globals as js values
+func (g *Global) Set(name string, value interface{}) {
+	g.Register(name, value)
+}
+
 func (g *Global) Get(name string) (interface{}, bool) {
 	v, ok := g.properties[name]
 	return v, ok
 }
-
-func Register(name string, prop interface{}) {
-	DefaultGlobal.Register(name, prop)
-}
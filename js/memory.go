@@ -0,0 +1,47 @@
+package js
+
+// Memory is the wasm memory, its buffer property is the Memory itself,
+// which converts to the []byte of the current memory
+type Memory struct {
+	memfunc func() []byte
+}
+
+func NewMemory(f func() []byte) *Memory {
+	return &Memory{
+		memfunc: f,
+	}
+}
+
+func (m *Memory) Get(name string) (interface{}, bool) {
+	return m, true
+}
+
+// Bytes returns the current memory
+func (m *Memory) Bytes() []byte {
+	return m.memfunc()
+}
+
+// MemoryView is a Uint8Array of the wasm memory. It keeps the offset of
+// the view rather than a slice, which would keep pointing at the old
+// buffer once the guest grows its memory.
+type MemoryView struct {
+	mem    *Memory
+	offset int64
+	len    int64
+}
+
+// Bytes returns the view in the current memory, nil if the view is
+// outside of the memory
+func (v *MemoryView) Bytes() []byte {
+	b := v.mem.Bytes()
+	if v.offset > int64(len(b)) || v.len > int64(len(b))-v.offset {
+		return nil
+	}
+	return b[v.offset : v.offset+v.len : v.offset+v.len]
+}
+
+// bytesView is implemented by views of the wasm memory, which convert to
+// []byte when passed to host functions
+type bytesView interface {
+	Bytes() []byte
+}
@@ -0,0 +1,138 @@
+package js
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NameMapper returns the js name of the exported field or method goName
+// of type t. An empty name hides the member from js.
+// The `js:"name"` tag of a struct field takes precedence over the
+// NameMapper, and `js:"-"` hides the field. The guest can only set the
+// fields with the rw option, like `js:",rw"` or `js:"name,rw"`.
+type NameMapper func(t reflect.Type, goName string) string
+
+// GoName is the default NameMapper, members keep their Go name.
+// For compatibility a js name that is not found is retried title cased,
+// so "writeSync" reaches the method WriteSync.
+func GoName(t reflect.Type, goName string) string {
+	return goName
+}
+
+// CamelCase is a NameMapper lowering the first letter of Go names,
+// WriteSync is exposed as writeSync
+func CamelCase(t reflect.Type, goName string) string {
+	r, n := utf8.DecodeRuneInString(goName)
+	return string(unicode.ToLower(r)) + goName[n:]
+}
+
+// SetNameMapper sets the NameMapper naming the members of Go values
+func (vm *VM) SetNameMapper(m NameMapper) {
+	vm.cfg.NameMapper = m
+	vm.types = make(map[reflect.Type]map[string]member)
+}
+
+// member is a field or method of a type exposed to js
+type member struct {
+	method int
+	field  []int
+	// rw is true for the fields the guest can set
+	rw bool
+}
+
+func (vm *VM) members(t reflect.Type) map[string]member {
+	if ms, ok := vm.types[t]; ok {
+		return ms
+	}
+	mapper := vm.cfg.NameMapper
+	if mapper == nil {
+		mapper = GoName
+	}
+	ms := make(map[string]member)
+	if st := t; st.Kind() == reflect.Struct || st.Kind() == reflect.Ptr && st.Elem().Kind() == reflect.Struct {
+		if st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		for _, f := range reflect.VisibleFields(st) {
+			if f.PkgPath != "" || f.Anonymous && f.Type.Kind() == reflect.Struct {
+				continue
+			}
+			name, opts := f.Tag.Get("js"), ""
+			if i := strings.IndexByte(name, ','); i >= 0 {
+				name, opts = name[:i], name[i+1:]
+			}
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = mapper(st, f.Name)
+			}
+			if name != "" {
+				ms[name] = member{method: -1, field: f.Index, rw: opts == "rw"}
+			}
+		}
+	}
+	// methods shadow fields, as in Go
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if name := mapper(t, m.Name); name != "" {
+			ms[name] = member{method: i}
+		}
+	}
+	vm.types[t] = ms
+	return ms
+}
+
+// lookup returns the member name of t, retried title cased
+func (vm *VM) lookup(t reflect.Type, name string) (member, bool) {
+	ms := vm.members(t)
+	m, ok := ms[name]
+	if !ok {
+		m, ok = ms[strings.Title(name)]
+	}
+	return m, ok
+}
+
+// member returns the field or method name of p
+func (vm *VM) member(p reflect.Value, name string) (reflect.Value, bool) {
+	if !p.IsValid() {
+		return reflect.Value{}, false
+	}
+	m, ok := vm.lookup(p.Type(), name)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return vm.resolve(p, m)
+}
+
+// settable returns the field name of p the guest can set, see member.rw
+func (vm *VM) settable(p reflect.Value, name string) (reflect.Value, bool) {
+	if !p.IsValid() {
+		return reflect.Value{}, false
+	}
+	m, ok := vm.lookup(p.Type(), name)
+	if !ok || !m.rw {
+		return reflect.Value{}, false
+	}
+	return vm.resolve(p, m)
+}
+
+// resolve returns the member m of p
+func (vm *VM) resolve(p reflect.Value, m member) (reflect.Value, bool) {
+	if m.method >= 0 {
+		return p.Method(m.method), true
+	}
+	if p.Kind() == reflect.Ptr {
+		if p.IsNil() {
+			return reflect.Value{}, false
+		}
+		p = p.Elem()
+	}
+	f, err := p.FieldByIndexErr(m.field)
+	if err != nil {
+		return reflect.Value{}, false
+	}
+	return f, true
+}
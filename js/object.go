@@ -0,0 +1,9 @@
+package js
+
+// Object is a plain js object, created by the Object constructor
+type Object map[string]interface{}
+
+// NewObject is the js Object constructor
+func NewObject() Object {
+	return make(Object)
+}
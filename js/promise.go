@@ -0,0 +1,414 @@
+package js
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+var callbackType = reflect.TypeOf(Callback(nil))
+
+// ErrPromiseCycle rejects a promise resolved with itself
+var ErrPromiseCycle = NewException("EINVAL", "chaining cycle detected for promise")
+
+// Callback completes an asynchronous host function, from any goroutine.
+//
+// A host function whose last parameter is a Callback is called node
+// style: the guest passes a function as last argument, which is called
+// with (err, result) once the Callback is called.
+type Callback func(result interface{}, err error)
+
+type promiseState int
+
+const (
+	promisePending promiseState = iota
+	promiseFulfilled
+	promiseRejected
+)
+
+// Promise implements js promises. Reactions registered with then run as
+// microtasks, once the guest call that settled the promise returns.
+//
+// Host functions can return a Promise to the guest and settle it later,
+// from any goroutine, with the Callback returned by NewPromise.
+type Promise struct {
+	// mu guards vm and early, set from other goroutines before the
+	// promise is handed to the guest
+	mu    sync.Mutex
+	vm    *VM
+	early func() error
+	// async is set for the promises of NewPromise, settled by the host
+	async bool
+
+	state     promiseState
+	result    interface{}
+	reactions []reaction
+}
+
+type reaction struct {
+	onFulfilled func(value interface{}) error
+	onRejected  func(reason interface{}) error
+}
+
+// NewPromise returns a pending Promise and the Callback settling it.
+// Only the first call of the Callback settles the Promise.
+func NewPromise() (*Promise, Callback) {
+	p := &Promise{async: true}
+	var once sync.Once
+	return p, func(value interface{}, err error) {
+		once.Do(func() {
+			p.postSettle(value, err)
+		})
+	}
+}
+
+func (vm *VM) newPromise() *Promise {
+	return &Promise{vm: vm}
+}
+
+// postSettle settles p on the goroutine running the guest
+func (p *Promise) postSettle(value interface{}, err error) {
+	settle := func() error {
+		if err != nil {
+			p.reject(err)
+		} else {
+			p.resolve(value)
+		}
+		return nil
+	}
+	p.mu.Lock()
+	vm := p.vm
+	if vm == nil {
+		p.early = settle
+	}
+	p.mu.Unlock()
+	if vm != nil {
+		vm.post(func() error {
+			vm.release()
+			return settle()
+		})
+	}
+}
+
+// bind attaches p to the vm it was handed to, on the goroutine running
+// the guest
+func (p *Promise) bind(vm *VM) {
+	p.mu.Lock()
+	if p.vm != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.vm = vm
+	early := p.early
+	p.early = nil
+	if early == nil && p.async {
+		vm.hold()
+	}
+	p.mu.Unlock()
+	if early != nil {
+		vm.queueMicrotask(early)
+	}
+}
+
+// resolve resolves p with x, adopting the state of x if it is a thenable
+func (p *Promise) resolve(x interface{}) {
+	if p.state != promisePending {
+		return
+	}
+	vm := p.vm
+	if v, ok := x.(*Value); ok {
+		if q, ok := v.Interface().(*Promise); ok {
+			x = q
+		}
+	}
+	if q, ok := x.(*Promise); ok {
+		if q == p {
+			p.reject(ErrPromiseCycle)
+			return
+		}
+		q.bind(vm)
+		q.subscribe(func(v interface{}) error {
+			p.resolve(v)
+			return nil
+		}, func(r interface{}) error {
+			p.reject(r)
+			return nil
+		})
+		return
+	}
+	if v, ok := x.(*Value); ok {
+		if prop, ok := vm.property(v.value, "then"); ok {
+			if then := vm.wrap("then", prop); vm.callable(then) {
+				resolve, reject := p.resolvingFuncs()
+				vm.queueMicrotask(func() error {
+					_, err := vm.callValue(then, v.ref, []Ref{resolve, reject})
+					return p.rejectOnException(err)
+				})
+				return
+			}
+		}
+	}
+	p.settle(promiseFulfilled, x)
+}
+
+func (p *Promise) reject(reason interface{}) {
+	if p.state != promisePending {
+		return
+	}
+	p.settle(promiseRejected, reason)
+}
+
+func (p *Promise) settle(state promiseState, result interface{}) {
+	p.state, p.result = state, result
+	reactions := p.reactions
+	p.reactions = nil
+	for _, r := range reactions {
+		p.queueReaction(r)
+	}
+}
+
+func (p *Promise) subscribe(onFulfilled, onRejected func(interface{}) error) {
+	r := reaction{onFulfilled, onRejected}
+	if p.state == promisePending {
+		p.reactions = append(p.reactions, r)
+		return
+	}
+	p.queueReaction(r)
+}
+
+func (p *Promise) queueReaction(r reaction) {
+	state, result := p.state, p.result
+	p.vm.queueMicrotask(func() error {
+		if state == promiseFulfilled {
+			return r.onFulfilled(result)
+		}
+		return r.onRejected(result)
+	})
+}
+
+// rejectOnException rejects p with the js exception err, other errors
+// stop the guest and are returned
+func (p *Promise) rejectOnException(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Exception); ok {
+		p.reject(err)
+		return nil
+	}
+	return err
+}
+
+// resolvingFuncs returns the js functions resolving and rejecting p
+func (p *Promise) resolvingFuncs() (resolve, reject Ref) {
+	vm := p.vm
+	resolve = vm.storeValue("resolve", func(v *Value) {
+		p.resolve(v)
+	})
+	reject = vm.storeValue("reject", func(v *Value) {
+		p.reject(v)
+	})
+	return resolve, reject
+}
+
+// Then registers the functions called with the value of p once it is
+// fulfilled, or with the reason once it is rejected. It returns a
+// promise resolved with the result of the function called.
+func (p *Promise) Then(onFulfilled, onRejected *Value) *Promise {
+	vm := p.vm
+	next := vm.newPromise()
+	handler := func(f *Value, settle func(interface{})) func(interface{}) error {
+		return func(arg interface{}) error {
+			if f == nil || !vm.callable(f) {
+				settle(arg)
+				return nil
+			}
+			ret, err := vm.callValue(f, ValueUndefined, []Ref{vm.resultRef(arg)})
+			if err != nil {
+				return next.rejectOnException(err)
+			}
+			next.resolve(vm.valueOf(ret))
+			return nil
+		}
+	}
+	p.subscribe(handler(onFulfilled, next.resolve), handler(onRejected, next.reject))
+	return next
+}
+
+// Catch is Then(undefined, onRejected)
+func (p *Promise) Catch(onRejected *Value) *Promise {
+	return p.Then(nil, onRejected)
+}
+
+// Finally registers onFinally, called without arguments once p is
+// settled. The returned promise settles like p.
+func (p *Promise) Finally(onFinally *Value) *Promise {
+	vm := p.vm
+	next := vm.newPromise()
+	handler := func(settle func(interface{})) func(interface{}) error {
+		return func(arg interface{}) error {
+			if onFinally != nil && vm.callable(onFinally) {
+				_, err := vm.callValue(onFinally, ValueUndefined, nil)
+				if err != nil {
+					return next.rejectOnException(err)
+				}
+			}
+			settle(arg)
+			return nil
+		}
+	}
+	p.subscribe(handler(next.resolve), handler(next.reject))
+	return next
+}
+
+// PromiseConstructor is the js Promise global
+type PromiseConstructor struct {
+	vm *VM
+}
+
+// Construct implements new Promise(executor). The executor is called with
+// the resolving functions. Guest functions can't be entered while the guest
+// calls the constructor, so a guest executor runs as a microtask.
+func (c *PromiseConstructor) Construct(args []Ref) (Ref, error) {
+	vm := c.vm
+	if len(args) == 0 {
+		return 0, ErrNotFunction
+	}
+	executor := vm.valueOf(args[0])
+	if !vm.callable(executor) {
+		return 0, ErrNotFunction
+	}
+	p := vm.newPromise()
+	resolve, reject := p.resolvingFuncs()
+	run := func() error {
+		_, err := vm.callValue(executor, ValueUndefined, []Ref{resolve, reject})
+		return p.rejectOnException(err)
+	}
+	if _, ok := executor.value.Interface().(*Func); ok {
+		vm.queueMicrotask(run)
+	} else if err := run(); err != nil {
+		return 0, err
+	}
+	return vm.storeValue("Promise", p), nil
+}
+
+// HasInstance implements InstanceChecker, the instances are the promises
+func (c *PromiseConstructor) HasInstance(v *Value) bool {
+	_, ok := v.Interface().(*Promise)
+	return ok
+}
+
+// Resolve returns a promise resolved with v, or v if it is a promise
+func (c *PromiseConstructor) Resolve(v *Value) *Promise {
+	if p, ok := v.Interface().(*Promise); ok {
+		return p
+	}
+	p := c.vm.newPromise()
+	p.resolve(v)
+	return p
+}
+
+// Reject returns a promise rejected with reason
+func (c *PromiseConstructor) Reject(reason *Value) *Promise {
+	p := c.vm.newPromise()
+	p.reject(reason)
+	return p
+}
+
+// All returns a promise fulfilled with the values of all values, once
+// they are all fulfilled, or rejected with the first rejection
+func (c *PromiseConstructor) All(values []interface{}) *Promise {
+	vm := c.vm
+	all := vm.newPromise()
+	results := make([]interface{}, len(values))
+	remaining := len(values)
+	if remaining == 0 {
+		all.resolve(results)
+		return all
+	}
+	for i, v := range values {
+		i := i
+		p := vm.newPromise()
+		p.resolve(v)
+		p.subscribe(func(v interface{}) error {
+			results[i] = v
+			remaining--
+			if remaining == 0 {
+				all.resolve(results)
+			}
+			return nil
+		}, func(r interface{}) error {
+			all.reject(r)
+			return nil
+		})
+	}
+	return all
+}
+
+// nodeCallback returns the Callback calling the guest function f node
+// style, f is nil if the guest passed no function
+func (vm *VM) nodeCallback(f *Func) Callback {
+	var once sync.Once
+	if f != nil {
+		vm.hold()
+	}
+	return func(result interface{}, err error) {
+		if f == nil {
+			return
+		}
+		once.Do(func() {
+			vm.post(func() error {
+				vm.release()
+				errArg := ValueNull
+				if err != nil {
+					errArg = vm.Exception(err)
+				}
+				_, ierr := vm.invokeFunc(f, ValueUndefined, []Ref{errArg, vm.ref(result)})
+				return ierr
+			})
+		})
+	}
+}
+
+// resultRef returns the reference of a promise value or reason
+func (vm *VM) resultRef(x interface{}) Ref {
+	if err, ok := x.(error); ok {
+		return vm.Exception(err)
+	}
+	return vm.ref(x)
+}
+
+// hold records an asynchronous host call the guest waits for, release
+// its completion
+func (vm *VM) hold() {
+	atomic.AddInt64(&vm.async, 1)
+}
+
+func (vm *VM) release() {
+	atomic.AddInt64(&vm.async, -1)
+}
+
+// AsyncPending returns the number of asynchronous host calls the guest
+// waits for: the promises returned by host functions not settled yet and
+// the callbacks passed to host functions not called yet
+func (vm *VM) AsyncPending() int64 {
+	return atomic.LoadInt64(&vm.async)
+}
+
+func (vm *VM) queueMicrotask(f func() error) {
+	vm.microtasks = append(vm.microtasks, f)
+}
+
+// RunMicrotasks runs the queued microtasks, including the ones they
+// queue, until the queue is empty. It must be called when the guest is
+// idle, by the goroutine running the guest.
+func (vm *VM) RunMicrotasks() error {
+	for len(vm.microtasks) > 0 {
+		f := vm.microtasks[0]
+		vm.microtasks = vm.microtasks[1:]
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
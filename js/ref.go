@@ -23,9 +23,15 @@ const (
 type Ref int64
 
 func (r Ref) Number() (int64, bool) {
+	f, ok := r.Float()
+	return int64(f), ok
+}
+
+// Float returns the number r holds, false if r refers to a stored value
+func (r Ref) Float() (float64, bool) {
 	f := *(*float64)(unsafe.Pointer(&r))
 	if f == f {
-		return int64(f), true
+		return f, true
 	}
 	return 0, false
 }
@@ -42,3 +48,113 @@ func (r Ref) String() string {
 	}
 	return fmt.Sprintf("0x%x", int64(r))
 }
+
+// Encoding is the way a guest boxes the js values in refs. The VM keeps
+// the refs of EncodingGo112, the refs of a guest using another encoding
+// are converted by VMRef and GuestRef when they cross the js syscalls.
+type Encoding int
+
+const (
+	// EncodingGo112 is the encoding of go1.11 to go1.13: the number zero
+	// is 0, undefined is the predefined id 1, the global object id 5, the
+	// memory id 6 and the Go object id 7
+	EncodingGo112 Encoding = iota
+	// EncodingGo114 is the encoding of go1.14 and later, and of TinyGo: 0
+	// is undefined, the number zero is the predefined id 1, the global
+	// object id 5 and the Go object id 6, and the boxed values carry
+	// their type in a flag
+	EncodingGo114
+)
+
+// the predefined ids and the type flags of EncodingGo114, see
+// predefValue in syscall/js
+const (
+	idZero   = 1
+	idGlobal = 5
+	idGo     = 6
+
+	flagNone     = 0
+	flagObject   = 1
+	flagString   = 2
+	flagSymbol   = 3
+	flagFunction = 4
+)
+
+// guestFlags are the type flags of the tags of the VM
+var guestFlags = [...]uint32{
+	tagString: flagString,
+	tagSymbol: flagSymbol,
+	tagFunc:   flagFunction,
+	tagObject: flagObject,
+}
+
+// vmTags are the tags of the VM of the type flags
+var vmTags = [...]uint32{
+	flagObject:   tagObject,
+	flagString:   tagString,
+	flagSymbol:   tagSymbol,
+	flagFunction: tagFunc,
+}
+
+// boxed returns the ref of the value id with the high bits flag
+func boxed(id int64, flag uint32) Ref {
+	return Ref(nanHead|flag)<<32 | Ref(uint32(id))
+}
+
+// GuestRef returns the ref of the guest for the ref of the VM ref
+func (e Encoding) GuestRef(ref Ref) Ref {
+	if e == EncodingGo112 {
+		return ref
+	}
+	if f, ok := ref.Float(); ok {
+		if f == 0 {
+			return boxed(idZero, flagNone)
+		}
+		return ref
+	}
+	switch ref {
+	case ValueUndefined:
+		return 0
+	case ValueGlobal:
+		return boxed(idGlobal, flagObject)
+	case ValueGo:
+		return boxed(idGo, flagObject)
+	case ValueMemory:
+		// go1.14 reads the memory from the instance, it has no ref
+		return 0
+	}
+	// NaN, null, true and false have the same ids and no tag
+	tag := uint32(ref>>32) &^ nanHead
+	if tag >= uint32(len(guestFlags)) {
+		return 0
+	}
+	return boxed(ref.ID(), guestFlags[tag])
+}
+
+// VMRef returns the ref of the VM for the ref of the guest ref, undefined
+// if ref is not a valid ref
+func (e Encoding) VMRef(ref Ref) Ref {
+	if e == EncodingGo112 {
+		return ref
+	}
+	if ref == 0 {
+		return ValueUndefined
+	}
+	if _, ok := ref.Float(); ok {
+		return ref
+	}
+	flag, id := uint32(ref>>32)&^nanHead, ref.ID()
+	switch {
+	case flag == flagNone && id == idZero:
+		return 0
+	case flag == flagObject && id == idGlobal:
+		return ValueGlobal
+	case flag == flagObject && id == idGo:
+		return ValueGo
+	case flag == flagNone:
+		return boxed(id, 0)
+	case flag >= uint32(len(vmTags)):
+		return ValueUndefined
+	}
+	return boxed(id, vmTags[flag])
+}
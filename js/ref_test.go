@@ -0,0 +1,53 @@
+package js
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncodingGo114(t *testing.T) {
+	e := EncodingGo114
+	tests := []struct {
+		name      string
+		vm, guest Ref
+	}{
+		{"undefined", ValueUndefined, 0},
+		{"zero", 0, nanHead<<32 | 1},
+		{"number", floatValue(1.5), floatValue(1.5)},
+		{"NaN", ValueNaN, nanHead << 32},
+		{"null", ValueNull, nanHead<<32 | 2},
+		{"true", ValueTrue, nanHead<<32 | 3},
+		{"false", ValueFalse, nanHead<<32 | 4},
+		{"global", ValueGlobal, (nanHead|1)<<32 | 5},
+		{"go", ValueGo, (nanHead|1)<<32 | 6},
+		{"string", (nanHead|tagString)<<32 | 8, (nanHead|2)<<32 | 8},
+		{"symbol", (nanHead|tagSymbol)<<32 | 9, (nanHead|3)<<32 | 9},
+		{"function", (nanHead|tagFunc)<<32 | 10, (nanHead|4)<<32 | 10},
+		{"object", (nanHead|tagObject)<<32 | 11, (nanHead|1)<<32 | 11},
+	}
+	for _, test := range tests {
+		if got := e.GuestRef(test.vm); got != test.guest {
+			t.Errorf("GuestRef(%s) = %#x, want %#x", test.name, int64(got), int64(test.guest))
+		}
+		if got := e.VMRef(test.guest); got != test.vm {
+			t.Errorf("VMRef(%s) = %#x, want %#x", test.name, int64(got), int64(test.vm))
+		}
+	}
+	if got := e.GuestRef(floatValue(math.Copysign(0, -1))); got != nanHead<<32|1 {
+		t.Errorf("GuestRef(-0) = %#x, want the zero", int64(got))
+	}
+	if got := e.VMRef((nanHead|7)<<32 | 8); got != ValueUndefined {
+		t.Errorf("VMRef(bad flag) = %#x, want undefined", int64(got))
+	}
+}
+
+func TestEncodingGo112(t *testing.T) {
+	for _, ref := range []Ref{0, ValueUndefined, ValueGlobal, ValueGo, (nanHead|tagObject)<<32 | 8} {
+		if got := EncodingGo112.GuestRef(ref); got != ref {
+			t.Errorf("GuestRef(%#x) = %#x", int64(ref), int64(got))
+		}
+		if got := EncodingGo112.VMRef(ref); got != ref {
+			t.Errorf("VMRef(%#x) = %#x", int64(ref), int64(got))
+		}
+	}
+}
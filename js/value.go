@@ -22,3 +22,16 @@ func defaultValue(ref Ref, name string) *Value {
 func (v *Value) String() string {
 	return fmt.Sprintf("%s", v.value.Interface())
 }
+
+// Interface returns the Go value v holds
+func (v *Value) Interface() interface{} {
+	if !v.value.IsValid() {
+		return nil
+	}
+	return v.value.Interface()
+}
+
+// Ref returns the reference of v
+func (v *Value) Ref() Ref {
+	return v.ref
+}
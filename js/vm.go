@@ -5,6 +5,7 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -12,11 +13,36 @@ type Getter interface {
 	Get(property string) (interface{}, bool)
 }
 
+// Setter is implemented by values whose properties can be set by js.
+// value is the *Value set by the guest.
+type Setter interface {
+	Set(property string, value interface{})
+}
+
+// Constructor is implemented by values the guest can call with new
+type Constructor interface {
+	Construct(args []Ref) (Ref, error)
+}
+
+// InstanceChecker is implemented by constructors telling their instances
+// for instanceof. The instances of the other constructors, Go functions,
+// are the values of their result type.
+type InstanceChecker interface {
+	HasInstance(v *Value) bool
+}
+
 type VM struct {
 	cfg     *VMConfig
 	valueid Ref
 	values  map[Ref]*Value
-	Log     *log.Logger
+	created int64
+	types   map[reflect.Type]map[string]member
+	goobj   *Go
+	// async is the number of asynchronous host calls pending
+	async int64
+	// microtasks run once the guest is idle, see RunMicrotasks
+	microtasks []func() error
+	Log        *log.Logger
 	//refs    map[reflect.Value]Ref
 }
 
@@ -24,8 +50,22 @@ type VMConfig struct {
 	// the wasm Memory
 	Memory *Memory
 
-	// if nil, DefaultGlobal will be used
+	// Global is the global object of the guest, the builtins are not
+	// registered implicitly, see RegisterBuiltins. If nil, a new Global
+	// with the builtins will be used.
 	Global *Global
+
+	// NameMapper names the fields and methods of Go values for js,
+	// if nil, GoName will be used
+	NameMapper NameMapper
+
+	// InvokeFunc calls the guest functions wrapped by Go._makeFuncWrapper,
+	// if nil, calling them fails with ErrNoSys
+	InvokeFunc FuncInvoker
+
+	// Post schedules f to run on the goroutine running the guest, it is
+	// called from any goroutine to complete asynchronous host functions
+	Post func(f func() error)
 }
 
 func NewVM(config *VMConfig) *VM {
@@ -33,11 +73,12 @@ func NewVM(config *VMConfig) *VM {
 		cfg:     config,
 		valueid: ValueGo + 1,
 		values:  make(map[Ref]*Value),
+		types:   make(map[reflect.Type]map[string]member),
 	}
 	if vm.cfg.Global == nil {
-		vm.cfg.Global = DefaultGlobal
+		vm.cfg.Global = NewGlobal()
+		RegisterBuiltins(vm.cfg.Global)
 	}
-	RegisterBuiltins(vm.cfg.Global)
 	vm.initDefaultValue()
 	return vm
 }
@@ -54,13 +95,17 @@ func (vm *VM) initDefaultValue() {
 		value: reflect.ValueOf(vm.cfg.Memory),
 	}
 
+	vm.goobj = &Go{
+		pendingEvent: vm.values[ValueNull],
+	}
 	goruntime := &Value{
 		name:  "Go",
 		ref:   ValueGo,
-		value: reflect.ValueOf(struct{}{}),
+		value: reflect.ValueOf(vm.goobj),
 	}
 	vm.values[ValueGo] = goruntime
 	vm.cfg.Global.Register("Go", goruntime)
+	vm.cfg.Global.Register("Promise", &PromiseConstructor{vm: vm})
 
 	vm.values[ValueGlobal] = &Value{
 		name:  "Gloabl",
@@ -110,6 +155,14 @@ func (vm *VM) storeValue(name string, x interface{}) Ref {
 		tag = tagString
 	case reflect.Func:
 		tag = tagFunc
+	case reflect.Ptr:
+		tag = tagObject
+		switch x := x.(type) {
+		case *Func:
+			tag = tagFunc
+		case *Promise:
+			x.bind(vm)
+		}
 	default:
 		tag = tagObject
 	}
@@ -120,9 +173,16 @@ func (vm *VM) storeValue(name string, x interface{}) Ref {
 		value: v,
 		ref:   ref,
 	}
+	atomic.AddInt64(&vm.created, 1)
 	return ref
 }
 
+// RefsCreated returns the number of values stored for the guest since the
+// VM was created, the values are never released
+func (vm *VM) RefsCreated() int64 {
+	return atomic.LoadInt64(&vm.created)
+}
+
 func (vm *VM) loadValue(ref Ref) (*Value, bool) {
 	n, ok := ref.Number()
 	if ok {
@@ -157,38 +217,243 @@ func (vm *VM) Property(ref Ref, name string) Ref {
 	return vm.storeValue(fullname, v)
 }
 
+// SetProperty sets the property name of ref to value. The guest sets the
+// properties of Setters and of maps with string keys, like Object, and
+// the struct fields tagged rw, see NameMapper. The other fields are read
+// only.
+func (vm *VM) SetProperty(ref Ref, name string, value Ref) error {
+	parent, ok := vm.values[ref]
+	if !ok {
+		return ErrUndefined
+	}
+	p := parent.value
+	v := vm.valueOf(value)
+
+	// Setter interface
+	if s, ok := p.Interface().(Setter); ok {
+		s.Set(name, v)
+		return nil
+	}
+
+	// Map, values of interface type keep the js value
+	if p.Kind() == reflect.Map && p.Type().Key().Kind() == reflect.String {
+		elem := reflect.ValueOf(v)
+		if et := p.Type().Elem(); et.Kind() != reflect.Interface || et.NumMethod() != 0 {
+			var err error
+			elem, err = vm.convert(value, et)
+			if err != nil {
+				return err
+			}
+		}
+		p.SetMapIndex(reflect.ValueOf(name).Convert(p.Type().Key()), elem)
+		return nil
+	}
+
+	// Field, only the ones opted in
+	field, ok := vm.settable(p, name)
+	if !ok || !field.CanSet() {
+		return ErrInvalidArgument
+	}
+	fv, err := vm.convert(value, field.Type())
+	if err != nil {
+		return err
+	}
+	field.Set(fv)
+	return nil
+}
+
+// DeleteProperty deletes the property name of ref, only the maps with
+// string keys, like Object, have properties to delete
+func (vm *VM) DeleteProperty(ref Ref, name string) error {
+	v, ok := vm.values[ref]
+	if !ok {
+		return ErrUndefined
+	}
+	p := v.value
+	if p.Kind() != reflect.Map || p.Type().Key().Kind() != reflect.String {
+		return ErrInvalidArgument
+	}
+	p.SetMapIndex(reflect.ValueOf(name).Convert(p.Type().Key()), reflect.Value{})
+	return nil
+}
+
+// InstanceOf reports whether ref is an instance of the constructor c
+func (vm *VM) InstanceOf(ref Ref, c Ref) bool {
+	v, ok := vm.loadValue(ref)
+	if !ok || !v.value.IsValid() {
+		return false
+	}
+	cv, ok := vm.values[c]
+	if !ok || !cv.value.IsValid() {
+		return false
+	}
+	if ic, ok := cv.value.Interface().(InstanceChecker); ok {
+		return ic.HasInstance(v)
+	}
+	ft := cv.value.Type()
+	if ft.Kind() != reflect.Func || ft.NumOut() == 0 || ft.Out(0).Kind() == reflect.Interface {
+		return false
+	}
+	return v.value.Type() == ft.Out(0)
+}
+
+// Index returns the element i of the array ref
+func (vm *VM) Index(ref Ref, i int64) Ref {
+	v, ok := vm.values[ref]
+	if !ok {
+		return ValueUndefined
+	}
+	p := indirect(v.value)
+	switch p.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+	default:
+		return ValueUndefined
+	}
+	if i < 0 || i >= int64(p.Len()) {
+		return ValueUndefined
+	}
+	elem := p.Index(int(i)).Interface()
+	if value, ok := elem.(*Value); ok {
+		return value.ref
+	}
+	return vm.storeValue(fmt.Sprintf("%s[%d]", v.name, i), elem)
+}
+
+// SetIndex sets the element i of the array ref to value
+func (vm *VM) SetIndex(ref Ref, i int64, value Ref) error {
+	v, ok := vm.values[ref]
+	if !ok {
+		return ErrUndefined
+	}
+	p := indirect(v.value)
+	if p.Kind() != reflect.Slice && p.Kind() != reflect.Array || i < 0 || i >= int64(p.Len()) {
+		return ErrInvalidArgument
+	}
+	elem := p.Index(int(i))
+	if !elem.CanSet() {
+		return ErrInvalidArgument
+	}
+	if et := elem.Type(); et.Kind() == reflect.Interface && et.NumMethod() == 0 {
+		elem.Set(reflect.ValueOf(vm.valueOf(value)))
+		return nil
+	}
+	ev, err := vm.convert(value, elem.Type())
+	if err != nil {
+		return err
+	}
+	elem.Set(ev)
+	return nil
+}
+
+// Length returns the length of the array, string or object ref
+func (vm *VM) Length(ref Ref) int64 {
+	v, ok := vm.values[ref]
+	if !ok {
+		return 0
+	}
+	p := indirect(v.value)
+	switch p.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String, reflect.Map:
+		return int64(p.Len())
+	}
+	return 0
+}
+
+// indirect returns the value pointed to by p, the current bytes of a
+// view of the wasm memory
+func indirect(p reflect.Value) reflect.Value {
+	if p.IsValid() && p.CanInterface() {
+		if bv, ok := p.Interface().(bytesView); ok {
+			return reflect.ValueOf(bv.Bytes())
+		}
+	}
+	return reflect.Indirect(p)
+}
+
+// ref returns the reference of the Go value x, stored if needed
+func (vm *VM) ref(x interface{}) Ref {
+	if v, ok := x.(*Value); ok {
+		return v.ref
+	}
+	return vm.storeValue("store", x)
+}
+
+func (vm *VM) invokeFunc(f *Func, this Ref, args []Ref) (Ref, error) {
+	if vm.cfg.InvokeFunc == nil {
+		return ValueUndefined, ErrNoSys
+	}
+	return vm.cfg.InvokeFunc(f, this, args)
+}
+
+func (vm *VM) post(f func() error) {
+	if vm.cfg.Post == nil {
+		return
+	}
+	vm.cfg.Post(f)
+}
+
+// valueOf returns the value of ref, undefined if ref is not stored
+func (vm *VM) valueOf(ref Ref) *Value {
+	v, ok := vm.loadValue(ref)
+	if !ok {
+		return vm.values[ValueUndefined]
+	}
+	return v
+}
+
+// wrap returns x as a *Value, without storing it
+func (vm *VM) wrap(name string, x interface{}) *Value {
+	if v, ok := x.(*Value); ok {
+		return v
+	}
+	return &Value{
+		name:  name,
+		value: reflect.ValueOf(x),
+	}
+}
+
+// callable reports whether v is a function the guest can call
+func (vm *VM) callable(v *Value) bool {
+	if !v.value.IsValid() {
+		return false
+	}
+	if _, ok := v.value.Interface().(*Func); ok {
+		return true
+	}
+	return v.value.Kind() == reflect.Func
+}
+
+// callValue calls the guest or host function v
+func (vm *VM) callValue(v *Value, this Ref, args []Ref) (Ref, error) {
+	return vm.call(v.name, this, v.value, args)
+}
+
 func (vm *VM) property(p reflect.Value, name string) (interface{}, bool) {
-	name = strings.Title(name)
-	// Getter interface
+	// Getter interface, the name is retried title cased for compatibility
 	if g, ok := p.Interface().(Getter); ok {
-		prop, ok := g.Get(name)
-		return prop, ok
+		if prop, ok := g.Get(name); ok {
+			return prop, true
+		}
+		return g.Get(strings.Title(name))
 	}
 
 	// Map
-	if p.Kind() == reflect.Map {
-		g := p.MapIndex(reflect.ValueOf(name))
-		if g.IsValid() {
-			return g.Interface(), true
+	if p.Kind() == reflect.Map && p.Type().Key().Kind() == reflect.String {
+		for _, key := range []string{name, strings.Title(name)} {
+			g := p.MapIndex(reflect.ValueOf(key).Convert(p.Type().Key()))
+			if g.IsValid() {
+				return g.Interface(), true
+			}
 		}
 		return nil, false
 	}
 
-	// Method
-	prop := p.MethodByName(name)
-	if prop.IsValid() {
-		return prop.Interface(), true
-	}
-
-	// FieldByName must not be a ptr
-	if p.Kind() == reflect.Ptr {
-		p = p.Elem()
-	}
-	prop = p.FieldByName(name)
-	if prop.IsValid() {
-		return prop.Interface(), true
+	// Method or field
+	prop, ok := vm.member(p, name)
+	if !ok {
+		return nil, false
 	}
-	return nil, false
+	return prop.Interface(), true
 }
 
 func (vm *VM) Exception(err error) Ref {
@@ -199,8 +464,21 @@ func (vm *VM) Exception(err error) Ref {
 	return vm.storeValue("error", e)
 }
 
-func (vm *VM) call(name string, f reflect.Value, args []Ref) (ret Ref, err error) {
-	retv := f.Call(vm.parseArgs(args))
+func (vm *VM) call(name string, this Ref, f reflect.Value, args []Ref) (ret Ref, err error) {
+	if !f.IsValid() {
+		return 0, ErrNotFunction
+	}
+	if fn, ok := f.Interface().(*Func); ok {
+		return vm.invokeFunc(fn, this, args)
+	}
+	if f.Kind() != reflect.Func {
+		return 0, ErrNotFunction
+	}
+	in, err := vm.convertArgs(f.Type(), args)
+	if err != nil {
+		return 0, err
+	}
+	retv := f.Call(in)
 	if len(retv) == 0 {
 		return ValueUndefined, nil
 	}
@@ -225,7 +503,10 @@ func (vm *VM) New(ref Ref, args []Ref) (Ref, error) {
 	if !ok {
 		return 0, ErrNotfound
 	}
-	return vm.call(v.name, v.value, args)
+	if c, ok := v.value.Interface().(Constructor); ok {
+		return c.Construct(args)
+	}
+	return vm.call(v.name, ValueUndefined, v.value, args)
 }
 
 func (vm *VM) Call(ref Ref, method string, args []Ref) (Ref, error) {
@@ -237,13 +518,16 @@ func (vm *VM) Call(ref Ref, method string, args []Ref) (Ref, error) {
 		return 0, ErrNotfound
 	}
 	name := fmt.Sprintf("%s.%s", v.name, method)
-	method = strings.Title(method)
-	f := v.value.MethodByName(method)
-	if !f.IsValid() {
+	prop, ok := vm.property(v.value, method)
+	if !ok {
 		return 0, ErrNotfound
 	}
+	f := reflect.ValueOf(prop)
+	if value, ok := prop.(*Value); ok {
+		f = value.value
+	}
 	// log.Printf("call %s, args: %v", name, args)
-	return vm.call(name, f, args)
+	return vm.call(name, ref, f, args)
 }
 
 func (vm *VM) Invoke(ref Ref, args []Ref) (Ref, error) {
@@ -254,7 +538,7 @@ func (vm *VM) Invoke(ref Ref, args []Ref) (Ref, error) {
 	if !ok {
 		return 0, ErrNotfound
 	}
-	return vm.call(v.name, v.value, args)
+	return vm.call(v.name, ValueUndefined, v.value, args)
 }
 
 func (vm *VM) Store(x interface{}) Ref {
@@ -269,17 +553,20 @@ func (vm *VM) Value(ref Ref) *Value {
 	return v
 }
 
-func (vm *VM) parseArgs(args []Ref) []reflect.Value {
-	var ret []reflect.Value
-	for _, arg := range args {
-		v, ok := vm.loadValue(arg)
-		if ok {
-			ret = append(ret, v.value)
-		} else {
-			panic("bad ref " + arg.String())
-		}
+// Bytes returns the bytes of the Uint8Array ref, false if ref is not a
+// Uint8Array. A view of the wasm memory returns the current memory.
+func (vm *VM) Bytes(ref Ref) ([]byte, bool) {
+	v, ok := vm.loadValue(ref)
+	if !ok {
+		return nil, false
+	}
+	switch b := v.Interface().(type) {
+	case []byte:
+		return b, true
+	case bytesView:
+		return b.Bytes(), true
 	}
-	return ret
+	return nil, false
 }
 
 func (vm *VM) DebugStr(ref Ref) string {
@@ -0,0 +1,90 @@
+package js
+
+import "testing"
+
+func TestDeleteProperty(t *testing.T) {
+	vm := NewVM(&VMConfig{})
+	obj := NewObject()
+	obj["a"] = 1
+	ref := vm.Store(obj)
+	if err := vm.DeleteProperty(ref, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obj["a"]; ok {
+		t.Error("a not deleted")
+	}
+	if err := vm.DeleteProperty(vm.Store(&struct{ A int }{}), "A"); err != ErrInvalidArgument {
+		t.Errorf("deleted a field: %v", err)
+	}
+}
+
+func TestInstanceOf(t *testing.T) {
+	vm := NewVM(&VMConfig{})
+	global := vm.Store(vm.cfg.Global)
+	object := vm.Property(global, "Object")
+	array := vm.Property(global, "Array")
+	promise := vm.Property(global, "Promise")
+	p, _ := NewPromise()
+
+	tests := []struct {
+		x    interface{}
+		c    Ref
+		want bool
+	}{
+		{NewObject(), object, true},
+		{NewObject(), array, false},
+		{[]interface{}{1}, array, true},
+		{"s", object, false},
+		{p, promise, true},
+		{NewObject(), promise, false},
+	}
+	for i, test := range tests {
+		if got := vm.InstanceOf(vm.Store(test.x), test.c); got != test.want {
+			t.Errorf("%d: %v instanceof %s = %v, want %v", i, test.x, vm.DebugStr(test.c), got, test.want)
+		}
+	}
+	if vm.InstanceOf(ValueUndefined, object) {
+		t.Error("undefined instanceof Object")
+	}
+}
+
+func TestSetProperty(t *testing.T) {
+	vm := NewVM(&VMConfig{})
+	x := &struct {
+		A int
+		B int `js:",rw"`
+		C int `js:"c,rw"`
+		D int `js:"d"`
+	}{}
+	ref := vm.Store(x)
+	one := vm.Store(1)
+
+	for _, name := range []string{"A", "d"} {
+		if err := vm.SetProperty(ref, name, one); err != ErrInvalidArgument {
+			t.Errorf("set %s: %v, want ErrInvalidArgument", name, err)
+		}
+	}
+	for _, name := range []string{"B", "c"} {
+		if err := vm.SetProperty(ref, name, one); err != nil {
+			t.Errorf("set %s: %v", name, err)
+		}
+	}
+	if x.A != 0 || x.B != 1 || x.C != 1 || x.D != 0 {
+		t.Errorf("got %+v, want only B and C set", *x)
+	}
+
+	obj := NewObject()
+	if err := vm.SetProperty(vm.Store(obj), "a", one); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := obj["a"].(*Value); !ok || v.Ref() != one {
+		t.Errorf("obj.a = %v, want 1", obj["a"])
+	}
+	g := vm.cfg.Global
+	if err := vm.SetProperty(vm.Store(g), "a", one); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Get("a"); !ok {
+		t.Error("global.a not set")
+	}
+}
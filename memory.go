@@ -0,0 +1,132 @@
+package gowasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrOutOfBounds is returned by accesses outside of the guest memory
+var ErrOutOfBounds = errors.New("gowasm: memory access out of bounds")
+
+// Memory gives host modules bounds checked access to the guest memory.
+// The memory is fetched from the VM on every access, so a Memory stays
+// valid when the guest grows its memory, unlike a []byte view.
+type Memory struct {
+	vm VM
+}
+
+// memoryFunc implements VM with a function
+type memoryFunc func() []byte
+
+func (f memoryFunc) Memory() []byte {
+	return f()
+}
+
+// NewMemory returns the Memory of vm
+func NewMemory(vm VM) *Memory {
+	return &Memory{
+		vm: vm,
+	}
+}
+
+// Size returns the current size of the memory in bytes
+func (m *Memory) Size() int64 {
+	return int64(len(m.vm.Memory()))
+}
+
+// span returns the n bytes at addr, aliasing the memory
+func (m *Memory) span(addr, n int64) ([]byte, error) {
+	mem := m.vm.Memory()
+	if addr < 0 || n < 0 || addr > int64(len(mem)) || n > int64(len(mem))-addr {
+		return nil, ErrOutOfBounds
+	}
+	return mem[addr : addr+n : addr+n], nil
+}
+
+// ReadBytes returns a copy of the n bytes at addr
+func (m *Memory) ReadBytes(addr, n int64) ([]byte, error) {
+	p, err := m.span(addr, n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), p...), nil
+}
+
+// WriteBytes copies b to addr
+func (m *Memory) WriteBytes(addr int64, b []byte) error {
+	p, err := m.span(addr, int64(len(b)))
+	if err != nil {
+		return err
+	}
+	copy(p, b)
+	return nil
+}
+
+// ReadString returns the n bytes at addr as a string
+func (m *Memory) ReadString(addr, n int64) (string, error) {
+	p, err := m.span(addr, n)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+// WriteString copies s to addr
+func (m *Memory) WriteString(addr int64, s string) error {
+	p, err := m.span(addr, int64(len(s)))
+	if err != nil {
+		return err
+	}
+	copy(p, s)
+	return nil
+}
+
+// ReadUint32 reads the little endian uint32 at addr
+func (m *Memory) ReadUint32(addr int64) (uint32, error) {
+	p, err := m.span(addr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(p), nil
+}
+
+// WriteUint32 writes v little endian at addr
+func (m *Memory) WriteUint32(addr int64, v uint32) error {
+	p, err := m.span(addr, 4)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(p, v)
+	return nil
+}
+
+// ReadUint64 reads the little endian uint64 at addr
+func (m *Memory) ReadUint64(addr int64) (uint64, error) {
+	p, err := m.span(addr, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(p), nil
+}
+
+// WriteUint64 writes v little endian at addr
+func (m *Memory) WriteUint64(addr int64, v uint64) error {
+	p, err := m.span(addr, 8)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(p, v)
+	return nil
+}
+
+// ReadFloat64 reads the float64 at addr
+func (m *Memory) ReadFloat64(addr int64) (float64, error) {
+	v, err := m.ReadUint64(addr)
+	return math.Float64frombits(v), err
+}
+
+// WriteFloat64 writes v at addr
+func (m *Memory) WriteFloat64(addr int64, v float64) error {
+	return m.WriteUint64(addr, math.Float64bits(v))
+}
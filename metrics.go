@@ -0,0 +1,100 @@
+package gowasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+const wasmPageSize = 65536
+
+// Metrics is a snapshot of the counters of a Runtime
+type Metrics struct {
+	// Calls is the number of calls per import, keyed by module.field
+	Calls map[string]uint64
+	// Exceptions is the number of js exceptions returned to the guest
+	Exceptions uint64
+	// BytesRead and BytesWritten count the bytes moved through fs.FS
+	BytesRead    uint64
+	BytesWritten uint64
+	// TimersScheduled is the number of timers requested by the guest
+	TimersScheduled uint64
+	// RefsCreated is the number of js refs handed to the guest, they
+	// are never released
+	RefsCreated int64
+	// PeakMemoryPages is the largest wasm memory size observed, in 64KiB pages
+	PeakMemoryPages int64
+}
+
+// WriteTo writes a human readable summary of m to w
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	names := make([]string, 0, len(m.Calls))
+	var total uint64
+	for name, n := range m.Calls {
+		names = append(names, name)
+		total += n
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ni, nj := m.Calls[names[i]], m.Calls[names[j]]
+		if ni != nj {
+			return ni > nj
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(buf, "host calls: %d\n", total)
+	for _, name := range names {
+		fmt.Fprintf(buf, "  %10d  %s\n", m.Calls[name], name)
+	}
+	fmt.Fprintf(buf, "exceptions: %d\n", m.Exceptions)
+	fmt.Fprintf(buf, "fs bytes read: %d\n", m.BytesRead)
+	fmt.Fprintf(buf, "fs bytes written: %d\n", m.BytesWritten)
+	fmt.Fprintf(buf, "timers scheduled: %d\n", m.TimersScheduled)
+	fmt.Fprintf(buf, "js refs created: %d\n", m.RefsCreated)
+	fmt.Fprintf(buf, "peak memory pages: %d\n", m.PeakMemoryPages)
+	return buf.WriteTo(w)
+}
+
+// callCounter is implemented by registries that count calls per import,
+// such as Resolver
+type callCounter interface {
+	Calls() map[string]uint64
+}
+
+type counters struct {
+	exceptions      uint64
+	timersScheduled uint64
+	peakPages       int64
+}
+
+func (rt *Runtime) observeMemory() {
+	if rt.wvm == nil {
+		return
+	}
+	pages := int64(len(rt.wvm.Memory()) / wasmPageSize)
+	for {
+		peak := atomic.LoadInt64(&rt.counters.peakPages)
+		if pages <= peak || atomic.CompareAndSwapInt64(&rt.counters.peakPages, peak, pages) {
+			return
+		}
+	}
+}
+
+// Metrics returns a snapshot of the runtime counters.
+// It is safe to call from any goroutine.
+func (rt *Runtime) Metrics() *Metrics {
+	m := &Metrics{
+		Calls:           make(map[string]uint64),
+		Exceptions:      atomic.LoadUint64(&rt.counters.exceptions),
+		TimersScheduled: atomic.LoadUint64(&rt.counters.timersScheduled),
+		RefsCreated:     rt.jsvm.RefsCreated(),
+		PeakMemoryPages: atomic.LoadInt64(&rt.counters.peakPages),
+	}
+	if rt.calls != nil {
+		m.Calls = rt.calls.Calls()
+	}
+	m.BytesRead, m.BytesWritten = rt.fs.BytesRead(), rt.fs.BytesWritten()
+	return m
+}
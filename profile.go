@@ -0,0 +1,214 @@
+package gowasm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StackSampler is implemented by wasm vms that can report the guest call
+// stack as function indices, innermost frame first.
+// GuestStack reads the engine state without synchronization, it is only
+// called from the goroutine running the guest.
+type StackSampler interface {
+	GuestStack() []uint32
+}
+
+// Profiler records the guest call stack of every host import call and
+// writes the counts in pprof format, using the function names from the
+// module's name section.
+//
+// It is an import call profile, not a cpu profile: the engines can't be
+// sampled while the guest runs, so the guest code calling no import, like
+// a hot loop, doesn't show up in it.
+type Profiler struct {
+	sampler StackSampler
+	syms    *Symbols
+
+	mu      sync.Mutex
+	samples map[string]*profSample
+	// start is the time of the first Start, since of the last one, zero
+	// when stopped
+	start   time.Time
+	since   time.Time
+	elapsed time.Duration
+}
+
+type profSample struct {
+	stack []uint32
+	count int64
+}
+
+// NewProfiler creates a Profiler recording the stacks reported by s
+func NewProfiler(s StackSampler, syms *Symbols) *Profiler {
+	return &Profiler{
+		sampler: s,
+		syms:    syms,
+		samples: make(map[string]*profSample),
+	}
+}
+
+// Start starts recording, the Resolver set with Resolver.SetProfiler
+// records the import calls
+func (p *Profiler) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.since = time.Now()
+	if p.start.IsZero() {
+		p.start = p.since
+	}
+}
+
+// Stop stops recording
+func (p *Profiler) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.since.IsZero() {
+		return
+	}
+	p.elapsed += time.Since(p.since)
+	p.since = time.Time{}
+}
+
+// record counts an import call from the current guest stack, it is called
+// by the Resolver on the goroutine running the guest
+func (p *Profiler) record() {
+	p.mu.Lock()
+	recording := !p.since.IsZero()
+	p.mu.Unlock()
+	if !recording {
+		return
+	}
+	stack := p.sampler.GuestStack()
+	if len(stack) == 0 {
+		return
+	}
+	var key strings.Builder
+	for _, idx := range stack {
+		var b [binary.MaxVarintLen32]byte
+		key.Write(b[:binary.PutUvarint(b[:], uint64(idx))])
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &profSample{stack: append([]uint32(nil), stack...)}
+		p.samples[key.String()] = s
+	}
+	s.count++
+}
+
+// WriteTo writes the gzipped pprof profile to w
+func (p *Profiler) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var strs []string
+	strIndex := make(map[string]int64)
+	str := func(s string) int64 {
+		if idx, ok := strIndex[s]; ok {
+			return idx
+		}
+		strIndex[s] = int64(len(strs))
+		strs = append(strs, s)
+		return strIndex[s]
+	}
+	str("")
+
+	prof := new(protobuf)
+	valueType := func(field int, typ, unit string) {
+		var vt protobuf
+		vt.int(1, str(typ))
+		vt.int(2, str(unit))
+		prof.message(field, &vt)
+	}
+	valueType(1, "calls", "count")
+
+	// one location and function per wasm function, both with id idx+1
+	funcs := make(map[uint32]bool)
+	for _, s := range p.samples {
+		var sample protobuf
+		locs := make([]uint64, len(s.stack))
+		for i, idx := range s.stack {
+			locs[i] = uint64(idx) + 1
+			funcs[idx] = true
+		}
+		sample.packed(1, locs)
+		sample.packed(2, []uint64{uint64(s.count)})
+		prof.message(2, &sample)
+	}
+	for idx := range funcs {
+		var loc, line protobuf
+		loc.int(1, int64(idx)+1)
+		loc.int(3, int64(idx))
+		line.int(1, int64(idx)+1)
+		loc.message(4, &line)
+		prof.message(4, &loc)
+
+		var fn protobuf
+		name := p.syms.FuncName(idx)
+		fn.int(1, int64(idx)+1)
+		fn.int(2, str(name))
+		fn.int(3, str(name))
+		prof.message(5, &fn)
+	}
+	prof.int(9, p.start.UnixNano())
+	prof.int(10, int64(p.elapsed))
+	for _, s := range strs {
+		prof.string(6, s)
+	}
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Write(prof.Bytes())
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// protobuf is a minimal protocol buffer encoder for the pprof format
+type protobuf struct {
+	bytes.Buffer
+}
+
+func (b *protobuf) varint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func (b *protobuf) key(field int, wiretype int) {
+	b.varint(uint64(field)<<3 | uint64(wiretype))
+}
+
+func (b *protobuf) int(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(uint64(x))
+}
+
+func (b *protobuf) string(field int, s string) {
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protobuf) packed(field int, xs []uint64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.message(field, &p)
+}
+
+func (b *protobuf) message(field int, m *protobuf) {
+	b.key(field, 2)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
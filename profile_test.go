@@ -0,0 +1,46 @@
+package gowasm
+
+import (
+	"bytes"
+	"testing"
+)
+
+type stackFunc func() []uint32
+
+func (f stackFunc) GuestStack() []uint32 {
+	return f()
+}
+
+// TestProfilerRecord checks that the Profiler counts the host calls by
+// guest stack, only while started
+func TestProfilerRecord(t *testing.T) {
+	stack := []uint32{3, 1}
+	p := NewProfiler(stackFunc(func() []uint32 { return stack }), nil)
+	r := NewResolver()
+	r.RegisterFunc("env", "f", func() {})
+	r.SetProfiler(p)
+	call := func() {
+		r.CallFunc("env", "f", nil, nil)
+	}
+
+	call()
+	p.Start()
+	call()
+	call()
+	stack = []uint32{2, 1}
+	call()
+	p.Stop()
+	call()
+
+	counts := make(map[uint32]int64)
+	for _, s := range p.samples {
+		counts[s.stack[0]] = s.count
+	}
+	if len(p.samples) != 2 || counts[3] != 2 || counts[2] != 1 {
+		t.Errorf("recorded %v, want 2 calls from 3 and 1 from 2", counts)
+	}
+	var b bytes.Buffer
+	if _, err := p.WriteTo(&b); err != nil || b.Len() == 0 {
+		t.Errorf("wrote %d bytes: %v", b.Len(), err)
+	}
+}
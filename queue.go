@@ -0,0 +1,130 @@
+package gowasm
+
+import "sync"
+
+// maxPendingEvents bounds the event queue, posting blocks while it is full
+const maxPendingEvents = 1024
+
+// event is a function posted to the runtime, or the timer id of a timer
+// that fired if f is nil
+type event struct {
+	f     func() error
+	timer int32
+}
+
+// eventQueue is the FIFO of the events waiting for the guest, shared by
+// the goroutine running the guest and the goroutines posting events
+type eventQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []event
+	limit  int
+	closed bool
+	// ready is signaled when an event is pushed, and by tryPop while
+	// events remain
+	ready chan struct{}
+}
+
+func newEventQueue(limit int) *eventQueue {
+	q := &eventQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends ev to the queue. If block is true it waits while the queue
+// is full, otherwise it fails. It fails once the queue is closed.
+func (q *eventQueue) push(ev event, block bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for block && !q.closed && len(q.events) >= q.limit {
+		q.cond.Wait()
+	}
+	if q.closed || len(q.events) >= q.limit {
+		return false
+	}
+	q.append(ev)
+	return true
+}
+
+// pushUnbounded appends ev even if the queue is full. It is used for the
+// completions of the asynchronous host calls of the guest, which can be
+// made from the goroutine running the guest, where waiting for room would
+// deadlock, and whose number is bounded by the calls of the guest. It fails
+// once the queue is closed.
+func (q *eventQueue) pushUnbounded(ev event) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.append(ev)
+	return true
+}
+
+func (q *eventQueue) append(ev event) {
+	q.events = append(q.events, ev)
+	q.cond.Broadcast()
+	q.signal()
+}
+
+// signal signals ready, unless it is already
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the first event, waiting for one. It fails once the queue
+// is closed.
+func (q *eventQueue) pop() (event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return event{}, false
+	}
+	ev := q.events[0]
+	q.events = q.events[1:]
+	q.cond.Broadcast()
+	return ev, true
+}
+
+// tryPop removes the first event, failing if there is none. ready is
+// signaled again if events remain, since it holds one signal for all the
+// events pushed meanwhile.
+func (q *eventQueue) tryPop() (event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) == 0 || q.closed {
+		return event{}, false
+	}
+	ev := q.events[0]
+	q.events = q.events[1:]
+	q.cond.Broadcast()
+	if len(q.events) != 0 {
+		q.signal()
+	}
+	return ev, true
+}
+
+// len returns the number of pending events
+func (q *eventQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// close drops the pending events and wakes up the goroutines waiting on q
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.events = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
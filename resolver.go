@@ -2,67 +2,191 @@ package gowasm
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type VM interface {
 	Memory() []byte
 }
 
+// Engine is implemented by wasm vms that can call the functions exported
+// by the module, which lets the Runtime drive the guest
+type Engine interface {
+	VM
+	// CallExport calls the exported function name with args
+	CallExport(name string, args ...int64) (int64, error)
+	// HasExport reports whether the module exports the function name
+	HasExport(name string) bool
+}
+
 type Registry interface {
 	Register(module, field string, f interface{})
 }
 
 type method struct {
-	Type reflect.Type
-	Func reflect.Value
+	Module string
+	Field  string
+	Type   reflect.Type
+	Func   reflect.Value
+	calls  uint64
+
+	// fast calls the function without reflection, if nil plan lays out
+	// the frame and args pools the argument values
+	fast func(*CallFrame)
+	plan *plan
+	args sync.Pool
+
+	// wasm is set for the functions registered with RegisterFunc
+	wasm *wasmFunc
+	// stub is the signature of the import for the stubs of the
+	// permissive mode
+	stub *Signature
+}
+
+// importKey is the key of an import, a struct rather than a concatenated
+// string so that looking up an import doesn't allocate
+type importKey struct {
+	module, field string
 }
 
 type Resolver struct {
-	modules map[string]*method
+	modules    map[importKey]*method
+	logger     *log.Logger
+	trace      bool
+	copySlices bool
+	stubs      bool
+	profiler   *Profiler
 }
 
 func NewResolver() *Resolver {
 	return &Resolver{
-		modules: make(map[string]*method),
+		modules: make(map[importKey]*method),
+		logger:  log.New(ioutil.Discard, "gowasm", log.LstdFlags),
 	}
 }
 
+// SetLogger sets the logger tracing the host function calls,
+// they are not traced by default
+func (r *Resolver) SetLogger(l *log.Logger) {
+	r.logger = l
+	r.trace = l != nil && l.Writer() != ioutil.Discard
+}
+
+// SetProfiler makes p record the guest stack of the host function calls
+func (r *Resolver) SetProfiler(p *Profiler) {
+	r.profiler = p
+}
+
+// Register registers f as the import module.field. It panics if the
+// guest can't call f, because a parameter or result type can't be laid
+// out in the guest memory.
+//
+// A func(*CallFrame) decodes its frame itself, and the signatures used by the
+// runtime imports are called without reflection. The frame layout of the
+// other functions is computed once here.
 func (r *Resolver) Register(module, field string, f interface{}) {
 	key := module + "." + field
-	r.modules[key] = &method{
-		Type: reflect.TypeOf(f),
-		Func: reflect.ValueOf(f),
+	t := reflect.TypeOf(f)
+	m := &method{
+		Module: module,
+		Field:  field,
+		Type:   t,
+		Func:   reflect.ValueOf(f),
+		fast:   fastCall(f),
+	}
+	if m.fast == nil {
+		if err := checkSignature(t); err != nil {
+			panic(fmt.Sprintf("gowasm: register %s: %s", key, err))
+		}
+		m.plan = compilePlan(t)
+		m.args.New = func() interface{} {
+			args := make([]reflect.Value, t.NumIn())
+			for i := range args {
+				args[i] = reflect.New(t.In(i)).Elem()
+			}
+			return args
+		}
 	}
+	r.modules[importKey{module, field}] = m
+}
+
+// SetCopySlices makes the host functions receive copies of the slices
+// passed by the guest, copied back to the memory when they return, instead
+// of views of the memory. The copies stay valid when the guest grows its
+// memory, which moves the memory, so the host functions can keep them.
+func (r *Resolver) SetCopySlices(copy bool) {
+	r.copySlices = copy
+}
+
+// Fields returns the sorted names of the functions registered in module
+func (r *Resolver) Fields(module string) []string {
+	var fields []string
+	for _, m := range r.modules {
+		if m.Module == module {
+			fields = append(fields, m.Field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
 }
 
 func (r *Resolver) CallMethod(module, field string, vm VM, sp int64) int64 {
-	if field != "runtime.wasmWrite" {
-		logger.Printf("call %s.%s", module, field)
+	if r.trace && field != "runtime.wasmWrite" {
+		r.logger.Printf("call %s.%s", module, field)
+	}
+	if r.profiler != nil {
+		r.profiler.record()
 	}
-	m, ok := r.modules[module+"."+field]
+	defer recoverHostPanic(module, field)
+	m, ok := r.modules[importKey{module, field}]
 	if !ok {
-		panic(fmt.Sprintf("%s.%s not found", module, field))
+		panic(&Fault{Import: module + "." + field, Reason: "import not found"})
 	}
+	if m.stub != nil {
+		return r.callStub(m)
+	}
+	if m.wasm != nil {
+		panic(&Fault{Import: module + "." + field, Reason: "called with a frame, want wasm values"})
+	}
+	atomic.AddUint64(&m.calls, 1)
 	return r.callMethod(m, vm, sp)
 }
 
+// Calls returns the number of calls of every import called at least once
+func (r *Resolver) Calls() map[string]uint64 {
+	calls := make(map[string]uint64)
+	for key, m := range r.modules {
+		n := atomic.LoadUint64(&m.calls)
+		if n != 0 {
+			calls[key.module+"."+key.field] = n
+		}
+	}
+	return calls
+}
+
 func (r *Resolver) callMethod(m *method, vm VM, sp int64) int64 {
-	mem := vm.Memory()
-	dec := NewDecoder(mem, sp+8)
-	mtype := m.Type
-	args := []reflect.Value{}
-	for i := 0; i < mtype.NumIn(); i++ {
-		argtype := mtype.In(i)
-		ref := reflect.New(argtype)
-		dec.Decode(ref)
-		args = append(args, ref.Elem())
+	f := newFrame(vm, sp, r.copySlices)
+	if m.fast != nil {
+		m.fast(f)
+		f.finish()
+	} else {
+		args := m.args.Get().([]reflect.Value)
+		m.plan.call(m.Func, f, args)
+		m.args.Put(args)
 	}
-	rets := m.Func.Call(args)
-	enc := NewEncoder(mem, dec.Offset())
-	for i := 0; i < len(rets); i++ {
-		ret := rets[i]
-		enc.Encode(ret)
+	err := f.err
+	f.release()
+	switch err {
+	case nil:
+	case errHostMemory:
+		panic(err)
+	default:
+		panic(&Fault{Import: m.Module + "." + m.Field, Reason: err.Error()})
 	}
 	return 0
 }
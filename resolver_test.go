@@ -0,0 +1,78 @@
+package gowasm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/icexin/gowasm/js"
+)
+
+// benchFrame returns a resolver with the runtime imports registered, and
+// a vm whose memory holds the frame at sp
+func benchFrame() (*Resolver, VM, []byte) {
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.RegisterModule("list", []int{1, 2, 3})
+	rt.Register(r)
+	mem := make([]byte, wasmPageSize)
+	vm := memoryFunc(func() []byte { return mem })
+	rt.SetVM(vm)
+	return r, vm, mem
+}
+
+const benchSP = 1024
+
+// valueGet writes the frame of syscall/js.valueGet of ref.name at benchSP
+func valueGetFrame(mem []byte, ref js.Ref, name string) {
+	copy(mem[2048:], name)
+	binary.LittleEndian.PutUint64(mem[benchSP+8:], uint64(ref))
+	binary.LittleEndian.PutUint64(mem[benchSP+16:], 2048)
+	binary.LittleEndian.PutUint64(mem[benchSP+24:], uint64(len(name)))
+}
+
+func BenchmarkValueGet(b *testing.B) {
+	r, vm, mem := benchFrame()
+	valueGetFrame(mem, js.ValueGlobal, "Object")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.CallMethod("go", "syscall/js.valueGet", vm, benchSP)
+	}
+}
+
+func BenchmarkValueLength(b *testing.B) {
+	r, vm, mem := benchFrame()
+	valueGetFrame(mem, js.ValueGlobal, "list")
+	r.CallMethod("go", "syscall/js.valueGet", vm, benchSP)
+	ref := binary.LittleEndian.Uint64(mem[benchSP+32:])
+	binary.LittleEndian.PutUint64(mem[benchSP+8:], ref)
+	r.CallMethod("go", "syscall/js.valueLength", vm, benchSP)
+	if n := binary.LittleEndian.Uint64(mem[benchSP+16:]); n != 3 {
+		b.Fatalf("length %d, want 3", n)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.CallMethod("go", "syscall/js.valueLength", vm, benchSP)
+	}
+}
+
+// BenchmarkPlanCall calls a host function with no fast path, through its
+// compiled plan and reflection
+func BenchmarkPlanCall(b *testing.B) {
+	r, vm, mem := benchFrame()
+	r.Register("env", "add", func(a, b int64, c int32) int64 {
+		return a + b + int64(c)
+	})
+	binary.LittleEndian.PutUint64(mem[benchSP+8:], 1)
+	binary.LittleEndian.PutUint64(mem[benchSP+16:], 2)
+	binary.LittleEndian.PutUint32(mem[benchSP+24:], 3)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.CallMethod("env", "add", vm, benchSP)
+	}
+	if n := binary.LittleEndian.Uint64(mem[benchSP+32:]); n != 6 {
+		b.Fatalf("result %d, want 6", n)
+	}
+}
@@ -3,10 +3,13 @@ package gowasm
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/icexin/gowasm/js"
@@ -14,7 +17,10 @@ import (
 )
 
 var (
-	logger = log.New(ioutil.Discard, "gowasm", log.LstdFlags)
+	ErrNoEngine = errors.New("gowasm: vm can't call exported functions")
+	ErrExited   = errors.New("gowasm: program has exited")
+	ErrBusy     = errors.New("gowasm: guest is already running")
+	ErrNoResume = errors.New("gowasm: module has no resume export")
 )
 
 // Runtime implements the runtime needed to run wasm code compiled by go toolchain
@@ -24,52 +30,421 @@ type Runtime struct {
 	global   *js.Global
 	jsvm     *js.VM
 	wvm      VM // wasm vm
-
-	timeOrigin time.Time
-	timerid    int32
-	timers     map[int32]*time.Timer
-	wakeupch   chan int32
+	engine   Engine
+	running  bool
+	draining bool
+	argc     int
+	argv     int
+	fs       *fs.FS
+	logger   *log.Logger
+	trace    bool
+	abi      ABI
+	// refs is how the guest boxes the js values, its refs are converted
+	// from and to the ones of jsvm by the js syscalls
+	refs js.Encoding
+	// wasi serves the wasi imports of TinyGo programs
+	wasi *WASI
+
+	calls    callCounter
+	counters counters
+
+	clock   clock
+	timerid int32
+	// timers are the pending timers of the guest, only accessed by the
+	// goroutine running the guest
+	timers map[int32]*timer
+	queue  *eventQueue
+	// holds is the number of Hold not released
+	holds int64
+	// state tells which goroutine can use the guest, see hold
+	state int32
 }
 
 func NewRuntime() *Runtime {
 	rt := &Runtime{
-		global:     js.NewGlobal(),
-		timeOrigin: time.Now(),
-		timers:     make(map[int32]*time.Timer),
-		wakeupch:   make(chan int32, 1000),
+		global: js.NewGlobal(),
+		clock:  newClock(),
+		timers: make(map[int32]*timer),
+		queue:  newEventQueue(maxPendingEvents),
+		fs:     fs.NewFS(),
+		logger: log.New(ioutil.Discard, "gowasm", log.LstdFlags),
 	}
 
 	jsmem := js.NewMemory(func() []byte {
 		return rt.wvm.Memory()
 	})
 	rt.jsvm = js.NewVM(&js.VMConfig{
-		Memory: jsmem,
-		Global: rt.global,
+		Memory:     jsmem,
+		Global:     rt.global,
+		InvokeFunc: rt.invokeFunc,
+		Post:       rt.post,
 	})
-	rt.global.Register("Fs", fs.NewFS())
+	js.RegisterBuiltins(rt.global)
+	rt.global.Register("Fs", rt.fs)
 	return rt
 }
 
-// SetVM set wasm vm
+// SetVM set wasm vm, Start, Run and calling guest functions
+// require vm to implement Engine
 func (rt *Runtime) SetVM(vm VM) {
 	rt.wvm = vm
+	rt.engine, _ = vm.(Engine)
+}
+
+// SetABI sets the ABI of the guest, ABIGo by default, see Inspect. It
+// must be called before Register, which registers the imports of the ABI.
+// ABIWASI is run by WASI, not Runtime.
+//
+// With ABITinyGo the imports use the plain wasm calling convention, so
+// Register requires a FuncRegistry, and the guest is started from _start.
+// Only the TinyGo ABI passing the js values as i64 refs is supported.
+//
+// The refs of the guest are converted to the ones of the js VM by the js
+// syscalls for the ABIs boxing the js values like go1.14, TinyGo's too.
+func (rt *Runtime) SetABI(abi ABI) {
+	rt.abi = abi
+	rt.refs = abi.refEncoding()
+}
+
+// ABI returns the ABI of the guest
+func (rt *Runtime) ABI() ABI {
+	return rt.abi
+}
+
+// Start writes args and envs to the guest memory and runs the guest until
+// it exits or waits for an event. It fails with the error of WriteArgs if
+// they don't fit.
+func (rt *Runtime) Start(args, envs []string) error {
+	if !rt.hold() {
+		return ErrBusy
+	}
+	defer rt.unhold()
+	return rt.start(args, envs)
+}
+
+func (rt *Runtime) start(args, envs []string) error {
+	if rt.engine == nil {
+		return ErrNoEngine
+	}
+	if rt.abi == ABITinyGo {
+		if rt.wasi != nil {
+			rt.wasi.SetVM(rt.wvm)
+			rt.wasi.args, rt.wasi.envs = args, envs
+		}
+		return rt.enter("_start")
+	}
+	argc, argv, err := WriteArgs(rt.wvm.Memory(), args, envs)
+	if err != nil {
+		return err
+	}
+	rt.argc, rt.argv = argc, argv
+	return rt.enter("run", int64(rt.argc), int64(rt.argv))
+}
+
+// Run starts the guest and runs it until it exits, waiting for the timers
+// it sets and the completion of asynchronous host functions.
+// A TinyGo program returning from main doesn't always exit, it has
+// exited with 0 once it waits for nothing: no timer, posted event,
+// asynchronous host call or Hold.
+func (rt *Runtime) Run(args, envs []string) error {
+	if !rt.hold() {
+		return ErrBusy
+	}
+	defer rt.unhold()
+	err := rt.start(args, envs)
+	for err == nil && !rt.exited {
+		if rt.abi == ABITinyGo && rt.idle() {
+			rt.wasmExit(0)
+			break
+		}
+		err = rt.wait()
+	}
+	return rt.stop(err)
+}
+
+// idle reports whether the guest waits for nothing
+func (rt *Runtime) idle() bool {
+	return len(rt.timers) == 0 && rt.queue.len() == 0 &&
+		rt.jsvm.AsyncPending() == 0 && atomic.LoadInt64(&rt.holds) == 0
+}
+
+// the states of a Runtime: Start, Run, Step and RunUntilIdle hold it for
+// the goroutine calling them, which lends it to the functions it posted.
+// Values hold it too when it is idle, see use.
+const (
+	stateIdle int32 = iota
+	stateHeld
+	stateLent
+)
+
+// hold holds the runtime for the calling goroutine, false if it is
+// already held
+func (rt *Runtime) hold() bool {
+	return atomic.CompareAndSwapInt32(&rt.state, stateIdle, stateHeld)
+}
+
+func (rt *Runtime) unhold() {
+	atomic.StoreInt32(&rt.state, stateIdle)
+}
+
+// use lets the host call of a Value use the guest, when the runtime is
+// idle or lent to a posted function, and returns the function to call once
+// done. It fails with ErrBusy while another goroutine holds the runtime.
+func (rt *Runtime) use() (done func(), err error) {
+	if rt.hold() {
+		return rt.unhold, nil
+	}
+	if atomic.LoadInt32(&rt.state) == stateLent {
+		return func() {}, nil
+	}
+	return nil, ErrBusy
+}
+
+// Hold keeps Run from exiting a TinyGo guest waiting for nothing, while
+// the host may still post events to it, until release is called. It must
+// be called before the guest can be idle, before Run for instance.
+func (rt *Runtime) Hold() (release func()) {
+	atomic.AddInt64(&rt.holds, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&rt.holds, -1)
+			// wake up Run to check if the guest is idle
+			rt.queue.pushUnbounded(event{f: func() error { return nil }})
+		})
+	}
+}
+
+// stop closes the event queue if err stopped the guest
+func (rt *Runtime) stop(err error) error {
+	if err != nil {
+		rt.queue.close()
+	}
+	return err
+}
+
+// Step handles the next timer or posted event if one is ready, without
+// waiting. The guest must have been started with Start.
+// It returns the deadline of the earliest pending timer, zero if the
+// guest has none, so the caller knows when to call Step again. Events
+// posted meanwhile are signaled on Ready. Step does nothing once the
+// guest exited, see Exited. It fails with ErrBusy if another goroutine
+// uses the guest.
+func (rt *Runtime) Step() (time.Time, error) {
+	if !rt.hold() {
+		return time.Time{}, ErrBusy
+	}
+	defer rt.unhold()
+	if !rt.exited {
+		rt.observeMemory()
+		if ev, ok := rt.queue.tryPop(); ok {
+			if err := rt.stop(rt.dispatch(ev)); err != nil {
+				return time.Time{}, err
+			}
+		}
+	}
+	return rt.nextDeadline(), nil
+}
+
+// RunUntilIdle handles the ready events until there are none left or the
+// guest exits, and returns the deadline of the earliest pending timer
+// like Step
+func (rt *Runtime) RunUntilIdle() (time.Time, error) {
+	if !rt.hold() {
+		return time.Time{}, ErrBusy
+	}
+	defer rt.unhold()
+	for !rt.exited {
+		rt.observeMemory()
+		ev, ok := rt.queue.tryPop()
+		if !ok {
+			break
+		}
+		if err := rt.stop(rt.dispatch(ev)); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return rt.nextDeadline(), nil
+}
+
+// Ready returns a channel receiving a value when an event is posted or a
+// timer fires, to wait for the next Step in a select loop. It receives a
+// value again when Step leaves events ready, so calling Step once per value
+// handles all of them.
+func (rt *Runtime) Ready() <-chan struct{} {
+	return rt.queue.ready
+}
+
+func (rt *Runtime) nextDeadline() time.Time {
+	var next time.Time
+	for _, t := range rt.timers {
+		if next.IsZero() || t.deadline.Before(next) {
+			next = t.deadline
+		}
+	}
+	return next
+}
+
+// wait waits for the next timer or posted event and handles it
+func (rt *Runtime) wait() error {
+	rt.observeMemory()
+	ev, ok := rt.queue.pop()
+	if !ok {
+		return ErrExited
+	}
+	return rt.dispatch(ev)
+}
+
+// dispatch resumes the guest for a timer, or runs a posted function
+func (rt *Runtime) dispatch(ev event) error {
+	if ev.f == nil {
+		// the timer may have been cleared after it fired
+		if _, ok := rt.timers[ev.timer]; !ok {
+			return nil
+		}
+		delete(rt.timers, ev.timer)
+		return rt.resume()
+	}
+	if err := rt.lend(ev.f); err != nil {
+		return err
+	}
+	return rt.runMicrotasks()
+}
+
+// lend runs the posted function f with the runtime lent to it, so that it
+// can call guest functions through Values
+func (rt *Runtime) lend(f func() error) error {
+	atomic.StoreInt32(&rt.state, stateLent)
+	defer atomic.StoreInt32(&rt.state, stateHeld)
+	return f()
+}
+
+// Post schedules f to run on the goroutine running the guest, while the
+// guest is idle, in order with the timers and the other posted functions.
+// f can call guest functions through Values, an error returned by f stops
+// Run.
+//
+// Post can be called from any goroutine, it blocks while the event queue
+// is full. It returns false if the guest has exited.
+func (rt *Runtime) Post(f func() error) bool {
+	return rt.queue.push(event{f: f}, true)
+}
+
+// TryPost is Post failing instead of blocking when the event queue is full
+func (rt *Runtime) TryPost(f func() error) bool {
+	return rt.queue.push(event{f: f}, false)
+}
+
+// post schedules the completion f of an asynchronous host call, without
+// blocking since it may be called by the guest itself
+func (rt *Runtime) post(f func() error) {
+	rt.queue.pushUnbounded(event{f: f})
+}
+
+func (rt *Runtime) resume() error {
+	// the timers of TinyGo run its scheduler
+	if rt.abi == ABITinyGo {
+		return rt.enter("go_scheduler")
+	}
+	// go1.11 has no resume export, the guest is resumed by calling run again
+	if !rt.engine.HasExport("resume") {
+		return rt.enter("run", int64(rt.argc), int64(rt.argv))
+	}
+	return rt.enter("resume")
+}
+
+func (rt *Runtime) enter(name string, args ...int64) error {
+	if rt.exited {
+		return ErrExited
+	}
+	if rt.running {
+		return ErrBusy
+	}
+	if err := rt.callExport(name, args...); err != nil {
+		return err
+	}
+	return rt.runMicrotasks()
+}
+
+// callExport calls the export name. A panic escaping the engine, if it
+// doesn't recover the panics of host functions, is returned as the error.
+// The error of the guest unwound by proc_exit is ignored.
+func (rt *Runtime) callExport(name string, args ...int64) (err error) {
+	rt.running = true
+	defer func() {
+		rt.running = false
+		if v := recover(); v != nil {
+			var ok bool
+			if err, ok = v.(error); !ok {
+				err = fmt.Errorf("%s panicked: %v", name, v)
+			}
+		}
+		if rt.exited && rt.abi == ABITinyGo {
+			err = nil
+		}
+	}()
+	_, err = rt.engine.CallExport(name, args...)
+	return err
+}
+
+// runMicrotasks runs the promise reactions queued by the guest call that
+// just returned. Microtasks entering the guest don't run them again, the
+// outermost call runs them all.
+func (rt *Runtime) runMicrotasks() error {
+	if rt.draining || rt.exited {
+		return nil
+	}
+	rt.draining = true
+	defer func() {
+		rt.draining = false
+	}()
+	return rt.jsvm.RunMicrotasks()
+}
+
+// invokeFunc calls the guest function f by making it the pending event
+// and resuming the guest, which stores the result on the event
+func (rt *Runtime) invokeFunc(f *js.Func, this js.Ref, args []js.Ref) (js.Ref, error) {
+	if rt.engine == nil {
+		return js.ValueUndefined, ErrNoEngine
+	}
+	if !rt.engine.HasExport("resume") {
+		return js.ValueUndefined, ErrNoResume
+	}
+	if rt.running {
+		return js.ValueUndefined, ErrBusy
+	}
+	ev := rt.jsvm.SetPendingEvent(f, this, args)
+	if err := rt.enter("resume"); err != nil {
+		return js.ValueUndefined, err
+	}
+	return rt.jsvm.EventResult(ev), nil
 }
 
 func (rt *Runtime) wasmExit(code int32) {
 	rt.exitcode = code
 	rt.exited = true
+	rt.observeMemory()
+	for id, t := range rt.timers {
+		t.timer.Stop()
+		delete(rt.timers, id)
+	}
+	rt.queue.close()
 }
 
 func (rt *Runtime) wasmWrite(fd int64, p int64, n int32) {
-	os.Stderr.Write(rt.wvm.Memory()[p : p+int64(n)])
+	mem := rt.wvm.Memory()
+	if p < 0 || n < 0 || p > int64(len(mem))-int64(n) {
+		panic(&Fault{Import: "go.runtime.wasmWrite", Reason: ErrOutOfBounds.Error()})
+	}
+	os.Stderr.Write(mem[p : p+int64(n)])
 }
 
 func (rt *Runtime) nanotime() int64 {
-	return int64(time.Since(rt.timeOrigin).Nanoseconds())
+	return rt.clock.monotonic()
 }
 
 func (rt *Runtime) walltime() (int64, int32) {
-	nsec := time.Now().UnixNano()
+	nsec := rt.clock.wall()
 	secs := nsec / 1e9
 	nsec = nsec - (secs * 1e9)
 	return secs, int32(nsec)
@@ -84,117 +459,192 @@ func (rt *Runtime) ExitCode() int32 {
 	return rt.exitcode
 }
 
-// WaitTimer waiting for timeout of timers set by go runtime in wasm
+// WaitTimer waiting for timeout of timers set by go runtime in wasm.
+// Posted functions are run meanwhile, their errors are ignored, use Run
+// to stop on them.
 func (rt *Runtime) WaitTimer() {
-	<-rt.wakeupch
+	rt.observeMemory()
+	for {
+		ev, ok := rt.queue.pop()
+		if !ok {
+			return
+		}
+		if ev.f == nil {
+			if _, ok := rt.timers[ev.timer]; ok {
+				delete(rt.timers, ev.timer)
+				return
+			}
+			continue
+		}
+		if ev.f() == nil {
+			rt.runMicrotasks()
+		}
+	}
+}
 
+// timer is a pending timer of the guest
+type timer struct {
+	deadline time.Time
+	timer    *time.Timer
 }
 
 func (rt *Runtime) scheduleCallback(delay int64) int32 {
+	atomic.AddUint64(&rt.counters.timersScheduled, 1)
 	rt.timerid++
 	id := rt.timerid
-	rt.timers[id] = time.AfterFunc(time.Millisecond*time.Duration(delay+1), func() {
-		rt.wakeupch <- id
-	})
+	d := time.Millisecond * time.Duration(delay+1)
+	rt.timers[id] = &timer{
+		deadline: time.Now().Add(d),
+		timer: time.AfterFunc(d, func() {
+			rt.queue.push(event{timer: id}, true)
+		}),
+	}
 	return id
 }
 
 func (rt *Runtime) clearScheduleCallback(id int32) {
-	timer, ok := rt.timers[id]
+	t, ok := rt.timers[id]
 	if !ok {
 		return
 	}
-	timer.Stop()
+	t.timer.Stop()
 	delete(rt.timers, id)
 }
 
+// resetMemoryDataView is called by the guest once it grew its memory.
+// The views of the memory handed to host code are resolved against the
+// current memory when used, there is nothing to invalidate.
+func (rt *Runtime) resetMemoryDataView() {
+	rt.observeMemory()
+}
+
 func (rt *Runtime) getRandomData(r []byte) {
 	rand.Read(r)
 }
 
 func (rt *Runtime) debug(v int64) {
-	log.Print(v)
+	rt.logger.Print(v)
+}
+
+// exception returns the guest ref of the exception err
+func (rt *Runtime) exception(err error) js.Ref {
+	atomic.AddUint64(&rt.counters.exceptions, 1)
+	return rt.guestRef(rt.jsvm.Exception(err))
+}
+
+// vmRef returns the ref of jsvm for the ref of the guest ref
+func (rt *Runtime) vmRef(ref js.Ref) js.Ref {
+	return rt.refs.VMRef(ref)
+}
+
+// vmRefs returns the refs of jsvm for the refs of the guest refs, refs
+// itself if the guest boxes the js values like jsvm
+func (rt *Runtime) vmRefs(refs []js.Ref) []js.Ref {
+	if rt.refs == js.EncodingGo112 {
+		return refs
+	}
+	vmrefs := make([]js.Ref, len(refs))
+	for i, ref := range refs {
+		vmrefs[i] = rt.refs.VMRef(ref)
+	}
+	return vmrefs
+}
+
+// guestRef returns the ref of the guest for the ref of jsvm ref
+func (rt *Runtime) guestRef(ref js.Ref) js.Ref {
+	return rt.refs.GuestRef(ref)
 }
 
 func (rt *Runtime) syscallJsValueGet(ref js.Ref, name string) js.Ref {
+	ref = rt.vmRef(ref)
 	ret := rt.jsvm.Property(ref, name)
-	logger.Printf("get %s.%s = %s", rt.jsvm.DebugStr(ref), name, rt.jsvm.DebugStr(ret))
-	return ret
+	if rt.trace {
+		rt.logger.Printf("get %s.%s = %s", rt.jsvm.DebugStr(ref), name, rt.jsvm.DebugStr(ret))
+	}
+	return rt.guestRef(ret)
 }
 
 func (rt *Runtime) syscallJsValueSet(ref js.Ref, name string, value js.Ref) {
+	ref, value = rt.vmRef(ref), rt.vmRef(value)
+	err := rt.jsvm.SetProperty(ref, name, value)
+	if err != nil {
+		rt.logger.Printf("set %s.%s: %s", rt.jsvm.DebugStr(ref), name, err)
+	}
+}
 
+func (rt *Runtime) syscallJsValueIndex(ref js.Ref, i int64) js.Ref {
+	return rt.guestRef(rt.jsvm.Index(rt.vmRef(ref), i))
+}
+
+func (rt *Runtime) syscallJsValueSetIndex(ref js.Ref, i int64, value js.Ref) {
+	ref, value = rt.vmRef(ref), rt.vmRef(value)
+	err := rt.jsvm.SetIndex(ref, i, value)
+	if err != nil {
+		rt.logger.Printf("set %s[%d]: %s", rt.jsvm.DebugStr(ref), i, err)
+	}
+}
+
+func (rt *Runtime) syscallJsValueLength(ref js.Ref) int64 {
+	return rt.jsvm.Length(rt.vmRef(ref))
+}
+
+// recoverException converts a panic of a js call into an exception thrown
+// to the guest, the reason is logged
+func (rt *Runtime) recoverException(ret *js.Ref, ok *bool) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err, isErr := v.(error)
+	if !isErr {
+		err = fmt.Errorf("%v", v)
+	}
+	rt.logger.Printf("js call panicked: %s", err)
+	*ret = rt.exception(err)
+	*ok = false
 }
 
 func (rt *Runtime) syscallJsValueNew(ref js.Ref, args []js.Ref) (ret js.Ref, ok bool) {
-	defer func() {
-		err := recover()
-		if err == nil {
-			return
-		}
-		err1, ok := err.(error)
-		if !ok {
-			err1 = fmt.Errorf("%s", err)
-		}
-		ret = rt.jsvm.Exception(err1)
-		ok = false
-	}()
+	defer rt.recoverException(&ret, &ok)
 
-	ret, err := rt.jsvm.New(ref, args)
+	ret, err := rt.jsvm.New(rt.vmRef(ref), rt.vmRefs(args))
 	if err != nil {
-		return rt.jsvm.Exception(err), false
+		return rt.exception(err), false
 	}
-	return ret, true
+	return rt.guestRef(ret), true
 }
 
 func (rt *Runtime) syscallJsValueCall(ref js.Ref, method string, args []js.Ref) (ret js.Ref, ok bool) {
-	defer func() {
-		err := recover()
-		if err == nil {
-			return
-		}
-		err1, ok := err.(error)
-		if !ok {
-			err1 = fmt.Errorf("%s", err)
-		}
-		ret = rt.jsvm.Exception(err1)
-		ok = false
-	}()
+	defer rt.recoverException(&ret, &ok)
 
-	ret, err := rt.jsvm.Call(ref, method, args)
+	ret, err := rt.jsvm.Call(rt.vmRef(ref), method, rt.vmRefs(args))
 	if err != nil {
-		return rt.jsvm.Exception(err), false
+		return rt.exception(err), false
 	}
-	return ret, true
+	return rt.guestRef(ret), true
 }
 
 func (rt *Runtime) syscallJsValueInvoke(ref js.Ref, args []js.Ref) (ret js.Ref, ok bool) {
-	defer func() {
-		err := recover()
-		if err != nil {
-			ret = rt.jsvm.Exception(err.(error))
-			ok = false
-		}
-	}()
+	defer rt.recoverException(&ret, &ok)
 
-	ret, err := rt.jsvm.Invoke(ref, args)
+	ret, err := rt.jsvm.Invoke(rt.vmRef(ref), rt.vmRefs(args))
 	if err != nil {
-		return rt.jsvm.Exception(err), false
+		return rt.exception(err), false
 	}
-	return ret, true
+	return rt.guestRef(ret), true
 }
 
 func (rt *Runtime) syscallJsValuePrepareString(ref js.Ref) (js.Ref, int64) {
-	v := rt.jsvm.Value(ref)
+	v := rt.jsvm.Value(rt.vmRef(ref))
 	if v == nil {
-		return js.ValueUndefined, 0
+		return rt.guestRef(js.ValueUndefined), 0
 	}
 	str := v.String()
-	return rt.jsvm.Store(str), int64(len(str))
+	return rt.guestRef(rt.jsvm.Store(str)), int64(len(str))
 }
 
 func (rt *Runtime) syscallJsValueLoadString(ref js.Ref, b []byte) {
-	v := rt.jsvm.Value(ref)
+	v := rt.jsvm.Value(rt.vmRef(ref))
 	if v == nil {
 		return
 	}
@@ -203,29 +653,122 @@ func (rt *Runtime) syscallJsValueLoadString(ref js.Ref, b []byte) {
 }
 
 func (rt *Runtime) syscallJsStringVal(value string) js.Ref {
-	return rt.jsvm.Store(value)
+	return rt.guestRef(rt.jsvm.Store(value))
+}
+
+func (rt *Runtime) syscallJsValueDelete(ref js.Ref, name string) {
+	ref = rt.vmRef(ref)
+	err := rt.jsvm.DeleteProperty(ref, name)
+	if err != nil {
+		rt.logger.Printf("delete %s.%s: %s", rt.jsvm.DebugStr(ref), name, err)
+	}
+}
+
+func (rt *Runtime) syscallJsValueInstanceOf(ref js.Ref, c js.Ref) bool {
+	return rt.jsvm.InstanceOf(rt.vmRef(ref), rt.vmRef(c))
+}
+
+// syscallJsFinalizeRef is called when the guest drops a js.Value, the
+// values are never released
+func (rt *Runtime) syscallJsFinalizeRef(ref js.Ref) {
 }
 
-// Register register the go runtime functions to Registry
+func (rt *Runtime) syscallJsCopyBytesToGo(dst []byte, src js.Ref) (int64, bool) {
+	b, ok := rt.jsvm.Bytes(rt.vmRef(src))
+	if !ok {
+		return 0, false
+	}
+	return int64(copy(dst, b)), true
+}
+
+func (rt *Runtime) syscallJsCopyBytesToJS(dst js.Ref, src []byte) (int64, bool) {
+	b, ok := rt.jsvm.Bytes(rt.vmRef(dst))
+	if !ok {
+		return 0, false
+	}
+	return int64(copy(b, src)), true
+}
+
+// Register register the go runtime functions to Registry.
+// If r counts calls per import, like Resolver, the counts are
+// reported by Metrics. The functions of ABITinyGo require r to be
+// a FuncRegistry.
 func (rt *Runtime) Register(r Registry) {
-	r.Register("go", "runtime.wasmExit", rt.wasmExit)
-	r.Register("go", "runtime.wasmWrite", rt.wasmWrite)
-	r.Register("go", "runtime.nanotime", rt.nanotime)
-	r.Register("go", "runtime.walltime", rt.walltime)
-	r.Register("go", "runtime.scheduleCallback", rt.scheduleCallback)
-	r.Register("go", "runtime.clearScheduledCallback", rt.clearScheduleCallback)
-	r.Register("go", "runtime.getRandomData", rt.getRandomData)
-	r.Register("go", "runtime.debug", rt.debug)
-	r.Register("go", "syscall/js.valueGet", rt.syscallJsValueGet)
-	r.Register("go", "syscall/js.valueSet", rt.syscallJsValueSet)
-	r.Register("go", "syscall/js.valueNew", rt.syscallJsValueNew)
-	r.Register("go", "syscall/js.valuePrepareString", rt.syscallJsValuePrepareString)
-	r.Register("go", "syscall/js.valueCall", rt.syscallJsValueCall)
-	r.Register("go", "syscall/js.valueInvoke", rt.syscallJsValueInvoke)
-	r.Register("go", "syscall/js.stringVal", rt.syscallJsStringVal)
-	r.Register("go", "syscall/js.valueLoadString", rt.syscallJsValueLoadString)
+	if c, ok := r.(callCounter); ok {
+		rt.calls = c
+	}
+	if rt.abi == ABITinyGo {
+		fr, ok := r.(FuncRegistry)
+		if !ok {
+			panic("gowasm: the tinygo abi requires a FuncRegistry")
+		}
+		rt.registerTinyGo(fr)
+		return
+	}
+	// go1.21 moved the imports of the js port from go to gojs
+	module := "go"
+	if rt.abi == ABIGoJS {
+		module = "gojs"
+	}
+	r.Register(module, "runtime.wasmExit", rt.wasmExit)
+	r.Register(module, "runtime.wasmWrite", rt.wasmWrite)
+	r.Register(module, "runtime.nanotime", rt.nanotime)
+	r.Register(module, "runtime.nanotime1", rt.nanotime)
+	r.Register(module, "runtime.walltime", rt.walltime)
+	r.Register(module, "runtime.walltime1", rt.walltime)
+	r.Register(module, "runtime.scheduleCallback", rt.scheduleCallback)
+	r.Register(module, "runtime.clearScheduledCallback", rt.clearScheduleCallback)
+	r.Register(module, "runtime.scheduleTimeoutEvent", rt.scheduleCallback)
+	r.Register(module, "runtime.clearTimeoutEvent", rt.clearScheduleCallback)
+	r.Register(module, "runtime.getRandomData", rt.getRandomData)
+	r.Register(module, "runtime.resetMemoryDataView", rt.resetMemoryDataView)
+	r.Register(module, "runtime.debug", rt.debug)
+	r.Register(module, "debug", rt.debug)
+	r.Register(module, "syscall/js.finalizeRef", rt.syscallJsFinalizeRef)
+	r.Register(module, "syscall/js.valueGet", rt.syscallJsValueGet)
+	r.Register(module, "syscall/js.valueSet", rt.syscallJsValueSet)
+	r.Register(module, "syscall/js.valueDelete", rt.syscallJsValueDelete)
+	r.Register(module, "syscall/js.valueIndex", rt.syscallJsValueIndex)
+	r.Register(module, "syscall/js.valueSetIndex", rt.syscallJsValueSetIndex)
+	r.Register(module, "syscall/js.valueLength", rt.syscallJsValueLength)
+	r.Register(module, "syscall/js.valueNew", rt.syscallJsValueNew)
+	r.Register(module, "syscall/js.valuePrepareString", rt.syscallJsValuePrepareString)
+	r.Register(module, "syscall/js.valueCall", rt.syscallJsValueCall)
+	r.Register(module, "syscall/js.valueInvoke", rt.syscallJsValueInvoke)
+	r.Register(module, "syscall/js.stringVal", rt.syscallJsStringVal)
+	r.Register(module, "syscall/js.valueLoadString", rt.syscallJsValueLoadString)
+	r.Register(module, "syscall/js.valueInstanceOf", rt.syscallJsValueInstanceOf)
+	r.Register(module, "syscall/js.copyBytesToGo", rt.syscallJsCopyBytesToGo)
+	r.Register(module, "syscall/js.copyBytesToJS", rt.syscallJsCopyBytesToJS)
+}
+
+// SetNameMapper sets how the fields and methods of registered modules
+// are named for js, see js.NameMapper
+func (rt *Runtime) SetNameMapper(m js.NameMapper) {
+	rt.jsvm.SetNameMapper(m)
 }
 
 func (rt *Runtime) RegisterModule(name string, svr interface{}) {
 	rt.global.Register(name, svr)
 }
+
+// Memory returns the bounds checked accessor of the guest memory,
+// for host modules reading or writing it
+func (rt *Runtime) Memory() *Memory {
+	return NewMemory(memoryFunc(func() []byte {
+		return rt.wvm.Memory()
+	}))
+}
+
+// FS returns the filesystem of the guest, opening files is denied until
+// its Sandbox is disabled
+func (rt *Runtime) FS() *fs.FS {
+	return rt.fs
+}
+
+// SetLogger sets the logger tracing the js syscalls of the guest and
+// printing the values of runtime.debug, they are discarded by default
+func (rt *Runtime) SetLogger(l *log.Logger) {
+	rt.logger = l
+	rt.trace = l != nil && l.Writer() != ioutil.Discard
+}
@@ -0,0 +1,232 @@
+package gowasm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icexin/gowasm/js"
+)
+
+// fakeEngine plays a guest of the js port calling the runtime through the
+// Resolver: run sets a timer of delay milliseconds, and resume reads a
+// property of the global object and exits with code
+type fakeEngine struct {
+	t      *testing.T
+	r      *Resolver
+	module string
+	mem    []byte
+	code   int32
+	delay  uint64
+}
+
+const fakeSP = 32768
+
+func newFakeEngine(t *testing.T, r *Resolver, code int32) *fakeEngine {
+	return &fakeEngine{
+		t:      t,
+		r:      r,
+		module: "go",
+		mem:    make([]byte, wasmPageSize),
+		code:   code,
+		delay:  1,
+	}
+}
+
+func (e *fakeEngine) Memory() []byte {
+	return e.mem
+}
+
+func (e *fakeEngine) HasExport(name string) bool {
+	return name == "run" || name == "resume"
+}
+
+func (e *fakeEngine) CallExport(name string, args ...int64) (int64, error) {
+	switch name {
+	case "run":
+		e.call("runtime.scheduleTimeoutEvent", e.delay)
+	case "resume":
+		if ref := e.valueGet(js.ValueGlobal, "Object"); ref == js.ValueUndefined {
+			e.t.Errorf("global.Object is undefined")
+		}
+		e.call("runtime.wasmExit", uint64(e.code))
+	}
+	return 0, nil
+}
+
+// call calls the import field of the module of e with the frame args and
+// returns the frame
+func (e *fakeEngine) call(field string, args ...uint64) []byte {
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(e.mem[fakeSP+8+8*i:], arg)
+	}
+	e.r.CallMethod(e.module, field, e, fakeSP)
+	return e.mem[fakeSP:]
+}
+
+// valueGet calls syscall/js.valueGet of ref.name and returns the ref
+func (e *fakeEngine) valueGet(ref js.Ref, name string) js.Ref {
+	copy(e.mem[fakeSP+1024:], name)
+	frame := e.call("syscall/js.valueGet", uint64(ref), fakeSP+1024, uint64(len(name)))
+	return js.Ref(binary.LittleEndian.Uint64(frame[32:]))
+}
+
+// TestParallelRuntimes runs Runtimes in parallel, each with its own
+// Resolver, while other goroutines post to them and read their metrics.
+// Run it with -race.
+func TestParallelRuntimes(t *testing.T) {
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		code := int32(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := NewResolver()
+			rt := NewRuntime()
+			rt.Register(r)
+			rt.SetVM(newFakeEngine(t, r, code))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for j := 0; j < 100; j++ {
+					rt.Metrics()
+					if !rt.TryPost(func() error { return nil }) {
+						return
+					}
+				}
+			}()
+			if err := rt.Run([]string{"guest"}, nil); err != nil {
+				t.Error(err)
+			}
+			<-done
+			if rt.ExitCode() != code {
+				t.Errorf("exit code %d, want %d", rt.ExitCode(), code)
+			}
+			if m := rt.Metrics(); m.TimersScheduled != 1 {
+				t.Errorf("%d timers scheduled, want 1", m.TimersScheduled)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestGoJSRefs checks the refs seen by a guest boxing the js values like
+// go1.14 and later
+func TestGoJSRefs(t *testing.T) {
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.SetABI(ABIGoJS)
+	rt.Register(r)
+	e := newFakeEngine(t, r, 0)
+	e.module = "gojs"
+	rt.SetVM(e)
+
+	const (
+		nanHead   = 0x7FF80000
+		undefined = js.Ref(0)
+		zero      = js.Ref(nanHead<<32 | 1)
+		global    = js.Ref((nanHead|1)<<32 | 5)
+		jsGo      = js.Ref((nanHead|1)<<32 | 6)
+	)
+	flag := func(ref js.Ref) int64 {
+		return int64(ref>>32) &^ nanHead
+	}
+	if ref := e.valueGet(global, "Go"); ref != jsGo {
+		t.Errorf("global.Go = %#x, want %#x", int64(ref), int64(jsGo))
+	}
+	if ref := e.valueGet(global, "Object"); flag(ref) != 4 {
+		t.Errorf("global.Object = %#x, want a function", int64(ref))
+	}
+	if ref := e.valueGet(global, "missing"); ref != undefined {
+		t.Errorf("global.missing = %#x, want undefined", int64(ref))
+	}
+	if ref := e.valueGet(undefined, "x"); ref != undefined {
+		t.Errorf("undefined.x = %#x, want undefined", int64(ref))
+	}
+
+	// an object holding the number zero
+	obj := rt.store(map[string]interface{}{"n": 0})
+	if ref := e.valueGet(rt.guestRef(obj), "n"); ref != zero {
+		t.Errorf("obj.n = %#x, want zero", int64(ref))
+	}
+	if flag(rt.guestRef(obj)) != 1 {
+		t.Errorf("obj = %#x, want an object", int64(rt.guestRef(obj)))
+	}
+}
+
+// TestRefsCreated checks that the refs created are counted, and not
+// decremented when the guest finalizes them
+func TestRefsCreated(t *testing.T) {
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.Register(r)
+	e := newFakeEngine(t, r, 0)
+	rt.SetVM(e)
+
+	n := rt.Metrics().RefsCreated
+	ref := rt.store(js.NewObject())
+	e.call("syscall/js.finalizeRef", uint64(ref))
+	if got := rt.Metrics().RefsCreated; got != n+1 {
+		t.Errorf("%d refs created, want %d", got, n+1)
+	}
+}
+
+// TestUseBusy calls the host through Values from another goroutine while
+// Run holds the runtime, and from a posted function. Run it with -race.
+func TestUseBusy(t *testing.T) {
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.Register(r)
+	e := newFakeEngine(t, r, 0)
+	e.delay = 60000
+	rt.SetVM(e)
+	rt.RegisterModule("double", func(x float64) float64 { return 2 * x })
+	double := rt.Global().Get("double")
+
+	errDone := errors.New("done")
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rt.Run(nil, nil)
+	}()
+	for atomic.LoadInt32(&rt.state) != stateHeld {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := double.Invoke(1); err != ErrBusy {
+		t.Errorf("Invoke while Run holds the runtime: %v, want ErrBusy", err)
+	}
+	if _, err := rt.Lookup("double").Call(context.Background(), 1); err != ErrBusy {
+		t.Errorf("Func.Call while Run holds the runtime: %v, want ErrBusy", err)
+	}
+	if _, err := rt.Step(); err != ErrBusy {
+		t.Errorf("Step while Run holds the runtime: %v, want ErrBusy", err)
+	}
+
+	var posted interface{}
+	rt.Post(func() error {
+		ret, err := double.Invoke(2)
+		if err != nil {
+			return err
+		}
+		posted = ret.Interface()
+		return errDone
+	})
+	if err := <-errc; err != errDone {
+		t.Fatalf("Run: %v, want the error of the posted function", err)
+	}
+	if posted != 4.0 {
+		t.Errorf("posted Invoke returned %v, want 4", posted)
+	}
+
+	// Run returned, the runtime is idle again
+	ret, err := rt.Lookup("double").Call(context.Background(), 3)
+	if err != nil || ret != 6.0 {
+		t.Errorf("Func.Call after Run: %v, %v, want 6", ret, err)
+	}
+}
@@ -0,0 +1,108 @@
+package gowasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// SetStubUnknown enables the permissive mode, to find out how far a guest
+// built by an unsupported toolchain gets and which imports it needs most:
+// Validate registers the function imports no function is registered for
+// as stubs, which log a warning on their first call to the logger of r
+// and return zero. Stubs reports their calls.
+//
+// The imports of the modules of functions registered with Register, like
+// a new import of the js port, take a frame whose layout is unknown: their
+// stubs write no results to it.
+func (r *Resolver) SetStubUnknown(stub bool) {
+	r.stubs = stub
+}
+
+// stubProblem returns why a stub can't implement the import imp, empty if
+// it can: stubs return zero, as at most one numeric result
+func (r *Resolver) stubProblem(imp Import) string {
+	sig := imp.Type
+	if len(sig.Results) > 1 {
+		return "has several results, it can't be stubbed"
+	}
+	for _, types := range [][]ValueType{sig.Params, sig.Results} {
+		for _, t := range types {
+			if t > F64 {
+				return "has a non numeric value, it can't be stubbed"
+			}
+		}
+	}
+	return ""
+}
+
+// frameModule reports whether functions of module are registered with
+// Register, taking a frame
+func (r *Resolver) frameModule(module string) bool {
+	for key, m := range r.modules {
+		if key.module == module && m.wasm == nil && m.stub == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// registerStub registers the stub of imp, taking a frame if imp has the
+// signature of the functions of its module registered with Register
+func (r *Resolver) registerStub(imp Import) {
+	sig := imp.Type
+	if r.frameModule(imp.Module) && sameTypes(sig.Params, frameSignature.Params) && len(sig.Results) == 0 {
+		sig = frameSignature
+	}
+	r.modules[importKey{imp.Module, imp.Field}] = &method{
+		Module: imp.Module,
+		Field:  imp.Field,
+		stub:   &sig,
+	}
+}
+
+func (r *Resolver) callStub(m *method) int64 {
+	if atomic.AddUint64(&m.calls, 1) == 1 {
+		r.logger.Printf("gowasm: %s.%s is not implemented, the stub returns zero", m.Module, m.Field)
+	}
+	return 0
+}
+
+// Stubs returns the number of calls of every stubbed import, including
+// the imports never called
+func (r *Resolver) Stubs() StubReport {
+	stubs := make(StubReport)
+	for key, m := range r.modules {
+		if m.stub != nil {
+			stubs[key.module+"."+key.field] = atomic.LoadUint64(&m.calls)
+		}
+	}
+	return stubs
+}
+
+// StubReport is the number of calls of the stubbed imports, keyed by
+// module.field
+type StubReport map[string]uint64
+
+// WriteTo writes the stubbed imports to w, the most called first
+func (s StubReport) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ni, nj := s[names[i]], s[names[j]]
+		if ni != nj {
+			return ni > nj
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(buf, "stubbed imports: %d\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(buf, "  %10d  %s\n", s[name], name)
+	}
+	return buf.WriteTo(w)
+}
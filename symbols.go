@@ -0,0 +1,234 @@
+package gowasm
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	wasmMagic              = 0x6d736100
+	sectionCustom          = 0
+	nameSubsectionFunction = 1
+)
+
+var errBadModule = errors.New("gowasm: malformed wasm module")
+
+// Symbols maps wasm function indices to the names recorded in the
+// module's name section, and function names to the source positions
+// recorded in its DWARF sections
+type Symbols struct {
+	funcs map[uint32]string
+	lines map[string]fileLine
+}
+
+type fileLine struct {
+	file string
+	line int
+}
+
+// Frame is a symbolized guest stack frame
+type Frame struct {
+	// Index is the index of the function in the function index space
+	Index uint32
+	Func  string
+	// File and Line locate the function entry, if the module has DWARF
+	File string
+	Line int
+}
+
+func (f Frame) String() string {
+	if f.File == "" {
+		return fmt.Sprintf("%s [%d]", f.Func, f.Index)
+	}
+	return fmt.Sprintf("%s [%d]\n\t%s:%d", f.Func, f.Index, f.File, f.Line)
+}
+
+// ReadSymbols parses the custom sections of the wasm binary code.
+// A module without a name section yields empty Symbols.
+// Malformed DWARF sections are ignored.
+func ReadSymbols(code []byte) (*Symbols, error) {
+	syms := &Symbols{
+		funcs: make(map[uint32]string),
+		lines: make(map[string]fileLine),
+	}
+	debug := make(map[string][]byte)
+	err := walkSections(code, func(id byte, payload []byte) error {
+		if id != sectionCustom {
+			return nil
+		}
+		r := bytes.NewReader(payload)
+		name, err := readName(r)
+		if err != nil {
+			return err
+		}
+		if name == "name" && syms.readNameSection(r) != nil {
+			return errBadModule
+		}
+		if strings.HasPrefix(name, ".debug_") {
+			debug[name] = payload[len(payload)-r.Len():]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	syms.readDWARF(debug)
+	return syms, nil
+}
+
+func (s *Symbols) readNameSection(r *bytes.Reader) error {
+	for r.Len() > 0 {
+		id, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if size > uint64(r.Len()) {
+			return errBadModule
+		}
+		sub := make([]byte, size)
+		r.Read(sub)
+		if id != nameSubsectionFunction {
+			continue
+		}
+		sr := bytes.NewReader(sub)
+		count, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			idx, err := binary.ReadUvarint(sr)
+			if err != nil {
+				return err
+			}
+			name, err := readName(sr)
+			if err != nil {
+				return err
+			}
+			s.funcs[uint32(idx)] = name
+		}
+	}
+	return nil
+}
+
+func (s *Symbols) readDWARF(sections map[string][]byte) error {
+	if sections[".debug_info"] == nil {
+		return nil
+	}
+	d, err := dwarf.New(sections[".debug_abbrev"], sections[".debug_aranges"],
+		sections[".debug_frame"], sections[".debug_info"], sections[".debug_line"],
+		sections[".debug_pubnames"], sections[".debug_ranges"], sections[".debug_str"])
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{".debug_addr", ".debug_line_str", ".debug_str_offsets", ".debug_rnglists"} {
+		if sections[name] != nil {
+			d.AddSection(name, sections[name])
+		}
+	}
+
+	r := d.Reader()
+	var lr *dwarf.LineReader
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return nil
+		}
+		switch e.Tag {
+		case dwarf.TagCompileUnit:
+			lr, _ = d.LineReader(e)
+		case dwarf.TagSubprogram:
+			lowpc, ok := e.Val(dwarf.AttrLowpc).(uint64)
+			if !ok || lr == nil {
+				continue
+			}
+			var le dwarf.LineEntry
+			if lr.SeekPC(lowpc, &le) != nil || le.File == nil {
+				continue
+			}
+			pos := fileLine{le.File.Name, le.Line}
+			for _, attr := range []dwarf.Attr{dwarf.AttrName, dwarf.AttrLinkageName} {
+				if name, ok := e.Val(attr).(string); ok {
+					s.lines[name] = pos
+				}
+			}
+		}
+	}
+}
+
+// Frame returns the symbolized frame of the function at index idx
+func (s *Symbols) Frame(idx uint32) Frame {
+	f := Frame{
+		Index: idx,
+		Func:  s.FuncName(idx),
+	}
+	if s != nil {
+		if pos, ok := s.lines[f.Func]; ok {
+			f.File, f.Line = pos.file, pos.line
+		}
+	}
+	return f
+}
+
+// FuncName returns the name of the function at index idx of the
+// function index space, imports included
+func (s *Symbols) FuncName(idx uint32) string {
+	if s != nil {
+		if name, ok := s.funcs[idx]; ok {
+			return name
+		}
+	}
+	return fmt.Sprintf("wasm-function[%d]", idx)
+}
+
+// walkSections calls f with the id and payload of every section of code
+func walkSections(code []byte, f func(id byte, payload []byte) error) error {
+	if len(code) < 8 || binary.LittleEndian.Uint32(code) != wasmMagic {
+		return errBadModule
+	}
+	r := bytes.NewReader(code[8:])
+	for r.Len() > 0 {
+		id, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errBadModule
+		}
+		if size > uint64(r.Len()) {
+			return errBadModule
+		}
+		off := len(code) - r.Len()
+		payload := code[off : off+int(size)]
+		r.Seek(int64(size), io.SeekCurrent)
+		if err := f(id, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readName(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", errBadModule
+	}
+	if n > uint64(r.Len()) {
+		return "", errBadModule
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
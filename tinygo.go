@@ -0,0 +1,203 @@
+package gowasm
+
+import (
+	"github.com/icexin/gowasm/js"
+)
+
+// tinygoModules are the modules of the imports of TinyGo programs, env
+// before TinyGo 0.24 and gojs since
+var tinygoModules = []string{"gojs", "env"}
+
+// registerTinyGo registers the imports of the js target of TinyGo
+func (rt *Runtime) registerTinyGo(r FuncRegistry) {
+	for _, module := range tinygoModules {
+		r.RegisterFunc(module, "runtime.ticks", rt.tinygoTicks)
+		r.RegisterFunc(module, "runtime.sleepTicks", rt.tinygoSleepTicks)
+		r.RegisterFunc(module, "syscall/js.finalizeRef", rt.tinygoFinalizeRef)
+		r.RegisterFunc(module, "syscall/js.stringVal", rt.tinygoStringVal)
+		r.RegisterFunc(module, "syscall/js.valueGet", rt.tinygoValueGet)
+		r.RegisterFunc(module, "syscall/js.valueSet", rt.tinygoValueSet)
+		r.RegisterFunc(module, "syscall/js.valueDelete", rt.tinygoValueDelete)
+		r.RegisterFunc(module, "syscall/js.valueIndex", rt.tinygoValueIndex)
+		r.RegisterFunc(module, "syscall/js.valueSetIndex", rt.tinygoValueSetIndex)
+		r.RegisterFunc(module, "syscall/js.valueLength", rt.tinygoValueLength)
+		r.RegisterFunc(module, "syscall/js.valueCall", rt.tinygoValueCall)
+		r.RegisterFunc(module, "syscall/js.valueInvoke", rt.tinygoValueInvoke)
+		r.RegisterFunc(module, "syscall/js.valueNew", rt.tinygoValueNew)
+		r.RegisterFunc(module, "syscall/js.valuePrepareString", rt.tinygoValuePrepareString)
+		r.RegisterFunc(module, "syscall/js.valueLoadString", rt.tinygoValueLoadString)
+		r.RegisterFunc(module, "syscall/js.valueInstanceOf", rt.tinygoValueInstanceOf)
+		r.RegisterFunc(module, "syscall/js.copyBytesToGo", rt.tinygoCopyBytesToGo)
+		r.RegisterFunc(module, "syscall/js.copyBytesToJS", rt.tinygoCopyBytesToJS)
+	}
+
+	// the wasi imports of the TinyGo runtime, writing to the stdio and
+	// exiting, share the filesystem and the clock of the runtime
+	w := newWASI(rt.fs, rt.clock)
+	rt.wasi = w
+	r.RegisterFunc(wasiModule, "args_get", w.argsGet)
+	r.RegisterFunc(wasiModule, "args_sizes_get", w.argsSizesGet)
+	r.RegisterFunc(wasiModule, "environ_get", w.environGet)
+	r.RegisterFunc(wasiModule, "environ_sizes_get", w.environSizesGet)
+	r.RegisterFunc(wasiModule, "clock_time_get", w.clockTimeGet)
+	r.RegisterFunc(wasiModule, "fd_close", w.fdClose)
+	r.RegisterFunc(wasiModule, "fd_fdstat_get", w.fdFdstatGet)
+	r.RegisterFunc(wasiModule, "fd_seek", w.fdSeek)
+	r.RegisterFunc(wasiModule, "fd_write", w.fdWrite)
+	r.RegisterFunc(wasiModule, "random_get", w.randomGet)
+	r.RegisterFunc(wasiModule, "proc_exit", rt.tinygoProcExit)
+}
+
+// tinygoFault panics with the fault of the import name
+func tinygoFault(name string, err error) {
+	if err != nil {
+		panic(&Fault{Import: name, Reason: err.Error()})
+	}
+}
+
+// tinygoString reads the string argument at p
+func tinygoString(m *Memory, name string, p, n uint32) string {
+	s, err := m.ReadString(int64(p), int64(n))
+	tinygoFault(name, err)
+	return s
+}
+
+// tinygoRefs reads the []js.Value argument at p
+func tinygoRefs(m *Memory, name string, p, n uint32) []js.Ref {
+	refs := make([]js.Ref, n)
+	for i := range refs {
+		v, err := m.ReadUint64(int64(p) + int64(i)*8)
+		tinygoFault(name, err)
+		refs[i] = js.Ref(v)
+	}
+	return refs
+}
+
+// tinygoResult writes the (ref, bool) result of a js call at ret
+func tinygoResult(m *Memory, name string, ret uint32, ref js.Ref, ok bool) {
+	tinygoFault(name, m.WriteUint64(int64(ret), uint64(ref)))
+	var b byte
+	if ok {
+		b = 1
+	}
+	tinygoFault(name, m.WriteBytes(int64(ret)+8, []byte{b}))
+}
+
+// tinygoTicks returns the wall time in milliseconds, the unit of the
+// timers of TinyGo
+func (rt *Runtime) tinygoTicks() float64 {
+	return float64(rt.clock.origin.UnixNano()+rt.clock.monotonic()) / 1e6
+}
+
+// tinygoSleepTicks runs the scheduler of the guest again after timeout
+// milliseconds
+func (rt *Runtime) tinygoSleepTicks(timeout float64) {
+	rt.scheduleCallback(int64(timeout))
+}
+
+// tinygoFinalizeRef is called when the guest drops a js.Value, the
+// values are never released
+func (rt *Runtime) tinygoFinalizeRef(ref uint64) {
+}
+
+func (rt *Runtime) tinygoProcExit(code int32) {
+	rt.wasmExit(code)
+	panic(&exitUnwind{code: code})
+}
+
+func (rt *Runtime) tinygoStringVal(m *Memory, p, n uint32) uint64 {
+	s := tinygoString(m, "syscall/js.stringVal", p, n)
+	return uint64(rt.syscallJsStringVal(s))
+}
+
+func (rt *Runtime) tinygoValueGet(m *Memory, v uint64, p, n uint32) uint64 {
+	name := tinygoString(m, "syscall/js.valueGet", p, n)
+	return uint64(rt.syscallJsValueGet(js.Ref(v), name))
+}
+
+func (rt *Runtime) tinygoValueSet(m *Memory, v uint64, p, n uint32, x uint64) {
+	name := tinygoString(m, "syscall/js.valueSet", p, n)
+	rt.syscallJsValueSet(js.Ref(v), name, js.Ref(x))
+}
+
+func (rt *Runtime) tinygoValueDelete(m *Memory, v uint64, p, n uint32) {
+	name := tinygoString(m, "syscall/js.valueDelete", p, n)
+	rt.syscallJsValueDelete(js.Ref(v), name)
+}
+
+func (rt *Runtime) tinygoValueIndex(v uint64, i int32) uint64 {
+	return uint64(rt.syscallJsValueIndex(js.Ref(v), int64(i)))
+}
+
+func (rt *Runtime) tinygoValueSetIndex(v uint64, i int32, x uint64) {
+	rt.syscallJsValueSetIndex(js.Ref(v), int64(i), js.Ref(x))
+}
+
+func (rt *Runtime) tinygoValueLength(v uint64) int32 {
+	return int32(rt.syscallJsValueLength(js.Ref(v)))
+}
+
+func (rt *Runtime) tinygoValueCall(m *Memory, ret uint32, v uint64, p, n, args, nargs, cargs uint32) {
+	const name = "syscall/js.valueCall"
+	method := tinygoString(m, name, p, n)
+	ref, ok := rt.syscallJsValueCall(js.Ref(v), method, tinygoRefs(m, name, args, nargs))
+	tinygoResult(m, name, ret, ref, ok)
+}
+
+func (rt *Runtime) tinygoValueInvoke(m *Memory, ret uint32, v uint64, args, nargs, cargs uint32) {
+	const name = "syscall/js.valueInvoke"
+	ref, ok := rt.syscallJsValueInvoke(js.Ref(v), tinygoRefs(m, name, args, nargs))
+	tinygoResult(m, name, ret, ref, ok)
+}
+
+func (rt *Runtime) tinygoValueNew(m *Memory, ret uint32, v uint64, args, nargs, cargs uint32) {
+	const name = "syscall/js.valueNew"
+	ref, ok := rt.syscallJsValueNew(js.Ref(v), tinygoRefs(m, name, args, nargs))
+	tinygoResult(m, name, ret, ref, ok)
+}
+
+// tinygoValuePrepareString writes the ref of the string and its length
+// at ret
+func (rt *Runtime) tinygoValuePrepareString(m *Memory, ret uint32, v uint64) {
+	const name = "syscall/js.valuePrepareString"
+	ref, n := rt.syscallJsValuePrepareString(js.Ref(v))
+	tinygoFault(name, m.WriteUint64(int64(ret), uint64(ref)))
+	tinygoFault(name, m.WriteUint32(int64(ret)+8, uint32(n)))
+}
+
+func (rt *Runtime) tinygoValueLoadString(m *Memory, v uint64, p, n, c uint32) {
+	b, err := m.span(int64(p), int64(n))
+	tinygoFault("syscall/js.valueLoadString", err)
+	rt.syscallJsValueLoadString(js.Ref(v), b)
+}
+
+func (rt *Runtime) tinygoValueInstanceOf(v, c uint64) bool {
+	return rt.syscallJsValueInstanceOf(js.Ref(v), js.Ref(c))
+}
+
+// tinygoCopyResult writes the number of bytes copied and the status of a
+// copy at ret, only the status if it failed
+func tinygoCopyResult(m *Memory, name string, ret uint32, n int64, ok bool) {
+	if !ok {
+		tinygoFault(name, m.WriteBytes(int64(ret)+4, []byte{0}))
+		return
+	}
+	tinygoFault(name, m.WriteUint32(int64(ret), uint32(n)))
+	tinygoFault(name, m.WriteBytes(int64(ret)+4, []byte{1}))
+}
+
+func (rt *Runtime) tinygoCopyBytesToGo(m *Memory, ret, p, n, c uint32, src uint64) {
+	const name = "syscall/js.copyBytesToGo"
+	dst, err := m.span(int64(p), int64(n))
+	tinygoFault(name, err)
+	copied, ok := rt.syscallJsCopyBytesToGo(dst, js.Ref(src))
+	tinygoCopyResult(m, name, ret, copied, ok)
+}
+
+func (rt *Runtime) tinygoCopyBytesToJS(m *Memory, ret uint32, dst uint64, p, n, c uint32) {
+	const name = "syscall/js.copyBytesToJS"
+	src, err := m.span(int64(p), int64(n))
+	tinygoFault(name, err)
+	copied, ok := rt.syscallJsCopyBytesToJS(js.Ref(dst), src)
+	tinygoCopyResult(m, name, ret, copied, ok)
+}
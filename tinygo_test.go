@@ -0,0 +1,199 @@
+package gowasm
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icexin/gowasm/js"
+)
+
+// tinygoEngine plays a TinyGo guest whose main returns at once, after
+// calling start
+type tinygoEngine struct {
+	mem   []byte
+	start func()
+}
+
+func (e *tinygoEngine) Memory() []byte {
+	return e.mem
+}
+
+func (e *tinygoEngine) HasExport(name string) bool {
+	return name == "_start"
+}
+
+func (e *tinygoEngine) CallExport(name string, args ...int64) (int64, error) {
+	if e.start != nil {
+		e.start()
+	}
+	return 0, nil
+}
+
+func newTinyGoRuntime(start func(rt *Runtime)) *Runtime {
+	rt := NewRuntime()
+	rt.SetABI(ABITinyGo)
+	rt.Register(NewResolver())
+	rt.SetVM(&tinygoEngine{
+		mem: make([]byte, wasmPageSize),
+		start: func() {
+			if start != nil {
+				start(rt)
+			}
+		},
+	})
+	return rt
+}
+
+func TestTinyGoExit(t *testing.T) {
+	rt := newTinyGoRuntime(nil)
+	if err := rt.Run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Exited() || rt.ExitCode() != 0 {
+		t.Errorf("exited %v with code %d, want exited with 0", rt.Exited(), rt.ExitCode())
+	}
+}
+
+// TestTinyGoPromise checks that a TinyGo guest isn't exited while it
+// waits for an asynchronous host call
+func TestTinyGoPromise(t *testing.T) {
+	rt := newTinyGoRuntime(func(rt *Runtime) {
+		p, cb := js.NewPromise()
+		// handing the promise to the guest binds it
+		rt.store(p)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cb(1, nil)
+		}()
+	})
+	if err := rt.Run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := rt.jsvm.AsyncPending(); n != 0 {
+		t.Errorf("exited with %d pending host calls", n)
+	}
+	if !rt.Exited() || rt.ExitCode() != 0 {
+		t.Errorf("exited %v with code %d, want exited with 0", rt.Exited(), rt.ExitCode())
+	}
+}
+
+// TestTinyGoHold checks that a TinyGo guest isn't exited before the events
+// of a Hold are posted
+func TestTinyGoHold(t *testing.T) {
+	var posted int32
+	rt := newTinyGoRuntime(nil)
+	release := rt.Hold()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rt.Post(func() error {
+			atomic.StoreInt32(&posted, 1)
+			return nil
+		})
+		release()
+	}()
+	if err := rt.Run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&posted) == 0 {
+		t.Error("exited before the hold was released")
+	}
+	if !rt.Exited() || rt.ExitCode() != 0 {
+		t.Errorf("exited %v with code %d, want exited with 0", rt.Exited(), rt.ExitCode())
+	}
+}
+
+func TestTinyGoRefs(t *testing.T) {
+	rt := newTinyGoRuntime(nil)
+	m := NewMemory(rt.wvm)
+	copy(rt.wvm.Memory(), "Go")
+	const (
+		global = (0x7FF80000|1)<<32 | 5
+		jsGo   = (0x7FF80000|1)<<32 | 6
+	)
+	if ref := rt.tinygoValueGet(m, global, 0, 2); ref != jsGo {
+		t.Errorf("global.Go = %#x, want %#x", ref, uint64(jsGo))
+	}
+	if ref := rt.tinygoValueGet(m, 0, 0, 2); ref != 0 {
+		t.Errorf("undefined.Go = %#x, want undefined", ref)
+	}
+}
+
+// tinygoImports are the imports of the js target of TinyGo, with their
+// wasm signatures
+var tinygoImports = map[string]Signature{
+	"runtime.ticks":                        {Results: []ValueType{F64}},
+	"runtime.sleepTicks":                   {Params: []ValueType{F64}},
+	"syscall/js.finalizeRef":               {Params: []ValueType{I64}},
+	"syscall/js.stringVal":                 {Params: []ValueType{I32, I32}, Results: []ValueType{I64}},
+	"syscall/js.valueGet":                  {Params: []ValueType{I64, I32, I32}, Results: []ValueType{I64}},
+	"syscall/js.valueSet":                  {Params: []ValueType{I64, I32, I32, I64}},
+	"syscall/js.valueDelete":               {Params: []ValueType{I64, I32, I32}},
+	"syscall/js.valueIndex":                {Params: []ValueType{I64, I32}, Results: []ValueType{I64}},
+	"syscall/js.valueSetIndex":             {Params: []ValueType{I64, I32, I64}},
+	"syscall/js.valueCall":                 {Params: []ValueType{I32, I64, I32, I32, I32, I32, I32}},
+	"syscall/js.valueInvoke":               {Params: []ValueType{I32, I64, I32, I32, I32}},
+	"syscall/js.valueNew":                  {Params: []ValueType{I32, I64, I32, I32, I32}},
+	"syscall/js.valueLength":               {Params: []ValueType{I64}, Results: []ValueType{I32}},
+	"syscall/js.valuePrepareString":        {Params: []ValueType{I32, I64}},
+	"syscall/js.valueLoadString":           {Params: []ValueType{I64, I32, I32, I32}},
+	"syscall/js.valueInstanceOf":           {Params: []ValueType{I64, I64}, Results: []ValueType{I32}},
+	"syscall/js.copyBytesToGo":             {Params: []ValueType{I32, I32, I32, I32, I64}},
+	"syscall/js.copyBytesToJS":             {Params: []ValueType{I32, I64, I32, I32, I32}},
+	"wasi_snapshot_preview1.fd_write":      {Params: []ValueType{I32, I32, I32, I32}, Results: []ValueType{I32}},
+	"wasi_snapshot_preview1.fd_close":      {Params: []ValueType{I32}, Results: []ValueType{I32}},
+	"wasi_snapshot_preview1.fd_fdstat_get": {Params: []ValueType{I32, I32}, Results: []ValueType{I32}},
+	"wasi_snapshot_preview1.fd_seek":       {Params: []ValueType{I32, I64, I32, I32}, Results: []ValueType{I32}},
+	"wasi_snapshot_preview1.proc_exit":     {Params: []ValueType{I32}},
+	"wasi_snapshot_preview1.random_get":    {Params: []ValueType{I32, I32}, Results: []ValueType{I32}},
+}
+
+func TestTinyGoImports(t *testing.T) {
+	for _, module := range tinygoModules {
+		var imports []Import
+		for name, sig := range tinygoImports {
+			imp := Import{Module: module, Field: name, Func: true, Type: sig}
+			if i := strings.IndexByte(name, '.'); name[:i] == wasiModule {
+				imp.Module, imp.Field = wasiModule, name[i+1:]
+			}
+			imports = append(imports, imp)
+		}
+		if abi := DetectABI(imports); abi != ABITinyGo {
+			t.Errorf("%s: detected %s, want %s", module, abi, ABITinyGo)
+		}
+		r := NewResolver()
+		rt := NewRuntime()
+		rt.SetABI(ABITinyGo)
+		rt.Register(r)
+		if err := r.Validate(imports); err != nil {
+			t.Errorf("%s: %v", module, err)
+		}
+	}
+}
+
+func TestTinyGoCopyBytes(t *testing.T) {
+	rt := newTinyGoRuntime(nil)
+	m := NewMemory(rt.wvm)
+	mem := rt.wvm.Memory()
+	buf := []byte("host")
+	ref := uint64(rt.guestRef(rt.store(buf)))
+	const ret = 1024
+
+	copy(mem[64:], "gu")
+	rt.tinygoCopyBytesToJS(m, ret, ref, 64, 2, 2)
+	if n, _ := m.ReadUint32(ret); n != 2 || mem[ret+4] != 1 || string(buf) != "gust" {
+		t.Errorf("copyBytesToJS copied %d bytes with status %d, the array is %q", n, mem[ret+4], buf)
+	}
+
+	rt.tinygoCopyBytesToGo(m, ret, 128, 8, 8, ref)
+	if n, _ := m.ReadUint32(ret); n != 4 || mem[ret+4] != 1 || string(mem[128:132]) != "gust" {
+		t.Errorf("copyBytesToGo copied %d bytes with status %d", n, mem[ret+4])
+	}
+
+	obj := uint64(rt.guestRef(rt.store(js.NewObject())))
+	rt.tinygoCopyBytesToGo(m, ret, 128, 8, 8, obj)
+	if mem[ret+4] != 0 {
+		t.Error("copied the bytes of an object")
+	}
+}
@@ -0,0 +1,98 @@
+package gowasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// Trap is the error of a guest execution that stopped abnormally, because
+// the guest trapped or a host function panicked
+type Trap struct {
+	// Cause is the error reported by the vm, a *HostPanic if a host
+	// function panicked
+	Cause error
+	// Stack is the guest call stack, innermost frame first
+	Stack []Frame
+}
+
+// NewTrap wraps the error err returned by vm into a Trap carrying the
+// guest call stack, if vm implements StackSampler
+func NewTrap(err error, vm VM, syms *Symbols) *Trap {
+	if trap, ok := err.(*Trap); ok {
+		return trap
+	}
+	trap := &Trap{
+		Cause: err,
+	}
+	if s, ok := vm.(StackSampler); ok {
+		for _, idx := range s.GuestStack() {
+			trap.Stack = append(trap.Stack, syms.Frame(idx))
+		}
+	}
+	return trap
+}
+
+func (t *Trap) Error() string {
+	return "wasm trap: " + t.Cause.Error()
+}
+
+// WriteTo writes the trap cause and the guest stack to w, followed by the
+// host stack if a host function panicked
+func (t *Trap) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, t.Error())
+	fmt.Fprintln(buf, "\nguest stack:")
+	for i, f := range t.Stack {
+		fmt.Fprintf(buf, "#%d %s\n", i, f)
+	}
+	if p, ok := t.Cause.(*HostPanic); ok {
+		fmt.Fprintf(buf, "\nhost stack:\n%s", p.Stack)
+	}
+	return buf.WriteTo(w)
+}
+
+// HostPanic is the cause of a Trap raised by a host function panicking
+type HostPanic struct {
+	// Import is the module.field name of the host function
+	Import string
+	Value  interface{}
+	// Stack is the host goroutine stack at the time of the panic
+	Stack []byte
+}
+
+func (p *HostPanic) Error() string {
+	return fmt.Sprintf("host function %s panicked: %v", p.Import, p.Value)
+}
+
+// Fault is the cause of a Trap raised because the guest called a host
+// function wrongly, the host function is not called
+type Fault struct {
+	// Import is the module.field name of the host function
+	Import string
+	// Reason tells what the guest did wrong
+	Reason string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("guest fault calling %s: %s", f.Import, f.Reason)
+}
+
+// recoverHostPanic converts a panic of the host function module.field into
+// a *HostPanic, which the vm reports as the error of the execution
+func recoverHostPanic(module, field string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	switch v.(type) {
+	case *HostPanic, *Fault, *exitUnwind:
+		panic(v)
+	}
+	panic(&HostPanic{
+		Import: module + "." + field,
+		Value:  v,
+		Stack:  debug.Stack(),
+	})
+}
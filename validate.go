@@ -0,0 +1,100 @@
+package gowasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImportProblem is an import of a module the Resolver can't satisfy
+type ImportProblem struct {
+	Import Import
+	Reason string
+}
+
+func (p ImportProblem) String() string {
+	return p.Import.String() + ": " + p.Reason
+}
+
+// ImportsError lists all the imports of a module the Resolver can't
+// satisfy, see Resolver.Validate
+type ImportsError struct {
+	// Module describes the module when it was inspected by NewRunner
+	Module   *ModuleInfo
+	Problems []ImportProblem
+}
+
+func (e *ImportsError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gowasm: %d imports of the module can't be resolved", len(e.Problems))
+	if e.Module != nil {
+		fmt.Fprintf(&b, " by the %s runtime", e.Module.ABI)
+		if e.Module.BuildInfo != nil && e.Module.BuildInfo.GoVersion != "" {
+			fmt.Fprintf(&b, ", the module was built by %s", e.Module.BuildInfo.GoVersion)
+		}
+	}
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n\t%s", p)
+	}
+	return b.String()
+}
+
+// Validate checks the imports of a module, read by ReadImports, against the
+// registered functions before the module runs: every import must be a
+// registered function of the same wasm signature. The functions registered
+// with Register take the sp, and have the signature (i32) -> (). Register
+// and RegisterFunc already reject the Go signatures the guest can't call.
+// It returns an *ImportsError listing all the problems, or nil.
+//
+// In the permissive mode, see SetStubUnknown, the function imports not
+// registered are registered as stubs instead of being reported, when a
+// stub can implement them.
+func (r *Resolver) Validate(imports []Import) error {
+	var problems []ImportProblem
+	for _, imp := range imports {
+		reason := r.check(imp)
+		if reason == reasonNotRegistered && r.stubs {
+			problem := r.stubProblem(imp)
+			if problem == "" {
+				r.registerStub(imp)
+				continue
+			}
+			reason += ", " + problem
+		}
+		if reason != "" {
+			problems = append(problems, ImportProblem{Import: imp, Reason: reason})
+		}
+	}
+	if len(problems) != 0 {
+		return &ImportsError{Problems: problems}
+	}
+	return nil
+}
+
+const reasonNotRegistered = "not registered"
+
+// check returns why the import imp can't be resolved, empty if it can
+func (r *Resolver) check(imp Import) string {
+	if !imp.Func {
+		return "only functions can be imported"
+	}
+	sig, ok := r.Signature(imp.Module, imp.Field)
+	if !ok {
+		return reasonNotRegistered
+	}
+	if !sameTypes(sig.Params, imp.Type.Params) || !sameTypes(sig.Results, imp.Type.Results) {
+		return fmt.Sprintf("imported as %s, registered as %s", imp.Type, sig)
+	}
+	return ""
+}
+
+func sameTypes(a, b []ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
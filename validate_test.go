@@ -0,0 +1,125 @@
+package gowasm
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestValidateStubs(t *testing.T) {
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.SetABI(ABIGoJS)
+	rt.Register(r)
+	r.RegisterFunc("env", "add", func(a, b int32) int32 { return a + b })
+	r.SetStubUnknown(true)
+	var logs bytes.Buffer
+	r.SetLogger(log.New(&logs, "", 0))
+
+	frame := Signature{Params: []ValueType{I32}}
+	imports := []Import{
+		{Module: "gojs", Field: "syscall/js.valueGet", Func: true, Type: frame},
+		{Module: "gojs", Field: "syscall/js.valueUnknown", Func: true, Type: frame},
+		{Module: "env", Field: "add", Func: true, Type: Signature{Params: []ValueType{I32, I32}, Results: []ValueType{I32}}},
+		{Module: "env", Field: "sub", Func: true, Type: Signature{Params: []ValueType{I32, I32}, Results: []ValueType{I32}}},
+		{Module: "env", Field: "pair", Func: true, Type: Signature{Results: []ValueType{I32, I32}}},
+		{Module: "math", Field: "abs", Func: true, Type: Signature{Params: []ValueType{F64}, Results: []ValueType{F64}}},
+	}
+	err := r.Validate(imports)
+	ierr, ok := err.(*ImportsError)
+	if !ok {
+		t.Fatalf("got error %v, want an *ImportsError", err)
+	}
+	want := map[string]string{
+		"env.pair": "has several results",
+	}
+	for _, p := range ierr.Problems {
+		name := p.Import.Module + "." + p.Import.Field
+		if !strings.Contains(p.Reason, want[name]) || want[name] == "" {
+			t.Errorf("%s: unexpected problem %q", name, p.Reason)
+		}
+		delete(want, name)
+	}
+	for name := range want {
+		t.Errorf("%s: not reported", name)
+	}
+
+	stubs := r.Stubs()
+	if len(stubs) != 3 {
+		t.Errorf("stubs %v, want gojs.syscall/js.valueUnknown, env.sub and math.abs", stubs)
+	}
+	if sig, _ := r.Signature("gojs", "syscall/js.valueUnknown"); !sig.Frame {
+		t.Errorf("the stub of gojs.syscall/js.valueUnknown doesn't take a frame")
+	}
+	if sig, _ := r.Signature("env", "sub"); sig.Frame {
+		t.Errorf("the stub of env.sub takes a frame")
+	}
+	mem := bytes.Repeat([]byte{0xff}, wasmPageSize)
+	r.CallMethod("gojs", "syscall/js.valueUnknown", memoryFunc(func() []byte { return mem }), 1024)
+	if !bytes.Equal(mem, bytes.Repeat([]byte{0xff}, wasmPageSize)) {
+		t.Error("the stub of gojs.syscall/js.valueUnknown wrote to the frame")
+	}
+	if n := r.Stubs()["gojs.syscall/js.valueUnknown"]; n != 1 {
+		t.Errorf("gojs.syscall/js.valueUnknown called %d times, want 1", n)
+	}
+	for i := 0; i < 2; i++ {
+		if ret := r.CallFunc("env", "sub", nil, []int64{1, 2}); ret != 0 {
+			t.Errorf("stub returned %d, want 0", ret)
+		}
+	}
+	if n := r.Stubs()["env.sub"]; n != 2 {
+		t.Errorf("env.sub called %d times, want 2", n)
+	}
+	if n := strings.Count(logs.String(), "env.sub is not implemented"); n != 1 {
+		t.Errorf("logged %d warnings, want 1:\n%s", n, logs.String())
+	}
+}
+
+// go114Imports are the imports of the guests built by go1.14 to go1.16
+var go114Imports = []string{
+	"debug",
+	"runtime.wasmExit",
+	"runtime.wasmWrite",
+	"runtime.resetMemoryDataView",
+	"runtime.nanotime1",
+	"runtime.walltime1",
+	"runtime.scheduleTimeoutEvent",
+	"runtime.clearTimeoutEvent",
+	"runtime.getRandomData",
+	"syscall/js.finalizeRef",
+	"syscall/js.stringVal",
+	"syscall/js.valueGet",
+	"syscall/js.valueSet",
+	"syscall/js.valueDelete",
+	"syscall/js.valueIndex",
+	"syscall/js.valueSetIndex",
+	"syscall/js.valueCall",
+	"syscall/js.valueInvoke",
+	"syscall/js.valueNew",
+	"syscall/js.valueLength",
+	"syscall/js.valuePrepareString",
+	"syscall/js.valueLoadString",
+	"syscall/js.valueInstanceOf",
+	"syscall/js.copyBytesToGo",
+	"syscall/js.copyBytesToJS",
+}
+
+func TestValidateGo114(t *testing.T) {
+	frame := Signature{Params: []ValueType{I32}}
+	var imports []Import
+	for _, field := range go114Imports {
+		imports = append(imports, Import{Module: "go", Field: field, Func: true, Type: frame})
+	}
+	abi := DetectABI(imports)
+	if abi != ABIGo114 {
+		t.Fatalf("detected %s, want %s", abi, ABIGo114)
+	}
+	r := NewResolver()
+	rt := NewRuntime()
+	rt.SetABI(abi)
+	rt.Register(r)
+	if err := r.Validate(imports); err != nil {
+		t.Error(err)
+	}
+}
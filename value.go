@@ -0,0 +1,179 @@
+package gowasm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/icexin/gowasm/js"
+)
+
+// Value is a host side handle to a js value of the guest
+type Value struct {
+	rt  *Runtime
+	ref js.Ref
+}
+
+// Global returns the js global object, which holds the values the guest
+// sets with js.Global().Set
+func (rt *Runtime) Global() Value {
+	return Value{rt, js.ValueGlobal}
+}
+
+// store converts the Go value x to a js value, Values keep their ref
+func (rt *Runtime) store(x interface{}) js.Ref {
+	if v, ok := x.(Value); ok {
+		return v.ref
+	}
+	return rt.jsvm.Store(x)
+}
+
+// Ref returns the js reference of v
+func (v Value) Ref() js.Ref {
+	return v.ref
+}
+
+// IsUndefined reports whether v is undefined
+func (v Value) IsUndefined() bool {
+	return v.ref == js.ValueUndefined
+}
+
+// Interface returns the Go value of v. Numbers are float64, null and
+// undefined are nil.
+func (v Value) Interface() interface{} {
+	switch v.ref {
+	case js.ValueUndefined, js.ValueNull:
+		return nil
+	case js.ValueTrue:
+		return true
+	case js.ValueFalse:
+		return false
+	}
+	if f, ok := v.ref.Float(); ok {
+		return f
+	}
+	jv := v.rt.jsvm.Value(v.ref)
+	if jv == nil {
+		return nil
+	}
+	return jv.Interface()
+}
+
+// Get returns the property name of v
+func (v Value) Get(name string) Value {
+	return Value{v.rt, v.rt.jsvm.Property(v.ref, name)}
+}
+
+// Set sets the property name of v to x
+func (v Value) Set(name string, x interface{}) error {
+	return v.rt.jsvm.SetProperty(v.ref, name, v.rt.store(x))
+}
+
+// Invoke calls the function v with args. Functions created by js.FuncOf
+// in the guest run by resuming the guest, which must be idle.
+//
+// Invoke, Call and Func.Call use the guest: while Start, Run, Step or
+// RunUntilIdle run on another goroutine they fail with ErrBusy, call them
+// from a function posted with Post instead.
+func (v Value) Invoke(args ...interface{}) (Value, error) {
+	done, err := v.rt.use()
+	if err != nil {
+		return Value{v.rt, js.ValueUndefined}, err
+	}
+	defer done()
+	ret, err := v.rt.jsvm.Invoke(v.ref, v.rt.storeArgs(args))
+	return Value{v.rt, ret}, err
+}
+
+// Call calls the method name of v with args, see Invoke
+func (v Value) Call(name string, args ...interface{}) (Value, error) {
+	done, err := v.rt.use()
+	if err != nil {
+		return Value{v.rt, js.ValueUndefined}, err
+	}
+	defer done()
+	ret, err := v.rt.jsvm.Call(v.ref, name, v.rt.storeArgs(args))
+	return Value{v.rt, ret}, err
+}
+
+func (rt *Runtime) storeArgs(args []interface{}) []js.Ref {
+	refs := make([]js.Ref, len(args))
+	for i, arg := range args {
+		refs[i] = rt.store(arg)
+	}
+	return refs
+}
+
+// Func is a function the guest set on the global object
+type Func struct {
+	rt   *Runtime
+	name string
+}
+
+// Lookup returns the function the guest set as the global name,
+// for example with js.Global().Set(name, js.FuncOf(f))
+func (rt *Runtime) Lookup(name string) *Func {
+	return &Func{rt, name}
+}
+
+// Call calls the function with args converted to js values, and returns
+// its result converted back to Go values, see Runtime.Decode.
+// The guest can't be interrupted, ctx is only checked before the call.
+// Like Value.Invoke it fails with ErrBusy while another goroutine uses
+// the guest.
+func (f *Func) Call(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	done, err := f.rt.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	fn := f.rt.Global().Get(f.name)
+	if fn.IsUndefined() {
+		return nil, fmt.Errorf("gowasm: function %s not found", f.name)
+	}
+	ret, err := f.rt.jsvm.Invoke(fn.ref, f.rt.storeArgs(args))
+	if err != nil {
+		return nil, err
+	}
+	return f.rt.Decode(Value{f.rt, ret}), nil
+}
+
+// Decode converts the js value v to Go values. Numbers are float64,
+// objects map[string]interface{} and arrays []interface{}. Other values
+// are returned as stored.
+func (rt *Runtime) Decode(v Value) interface{} {
+	return rt.decode(v.Interface())
+}
+
+// decode converts x, a stored Go value or a js value set by the guest
+func (rt *Runtime) decode(x interface{}) interface{} {
+	switch x := x.(type) {
+	case *js.Value:
+		return rt.Decode(Value{rt, x.Ref()})
+	case js.Object:
+		m := make(map[string]interface{}, len(x))
+		for k, elem := range x {
+			m[k] = rt.decode(elem)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(x))
+		for i, elem := range x {
+			s[i] = rt.decode(elem)
+		}
+		return s
+	case int:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint32:
+		return float64(x)
+	case float32:
+		return float64(x)
+	}
+	return x
+}
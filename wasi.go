@@ -0,0 +1,956 @@
+package gowasm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/icexin/gowasm/js"
+	"github.com/icexin/gowasm/js/fs"
+)
+
+// wasiModule is the module of the imports of GOOS=wasip1 programs
+const wasiModule = "wasi_snapshot_preview1"
+
+// FuncRegistry is implemented by registries of functions called with the
+// plain wasm calling convention, such as Resolver
+type FuncRegistry interface {
+	RegisterFunc(module, field string, f interface{})
+}
+
+// Runner runs a guest: Runtime runs the programs of the js port, WASI the
+// programs of the wasip1 port
+type Runner interface {
+	SetVM(vm VM)
+	Run(args, envs []string) error
+	Metrics() *Metrics
+	// ExitCode returns the code the guest exited with, zero if it
+	// returned from main
+	ExitCode() int32
+}
+
+// WASI implements the wasi_snapshot_preview1 imports needed to run wasm
+// code compiled by the go toolchain with GOOS=wasip1, which starts at the
+// _start export instead of run.
+//
+// Files are read and written through the same fs.FS as Runtime. The
+// guest can only open files below the directories given to Preopen, and
+// not at all until the Sandbox of the FS is disabled.
+type WASI struct {
+	wvm      VM
+	engine   Engine
+	args     []string
+	envs     []string
+	fs       *fs.FS
+	clock    clock
+	exitcode int32
+	exited   bool
+	calls    callCounter
+
+	// files are the open files of the guest by wasi fd
+	files  map[int32]*wasiFile
+	nextfd int32
+}
+
+// wasiFile is an open file of the guest
+type wasiFile struct {
+	fd    int    // host fd
+	path  string // host path of a directory
+	flags uint32 // wasi fdflags
+	// name is the guest path of a preopened directory
+	name    string
+	preopen bool
+}
+
+// WASI errnos
+const (
+	errnoSuccess    int32 = 0
+	errnoBadf       int32 = 8
+	errnoFault      int32 = 21
+	errnoInval      int32 = 28
+	errnoIO         int32 = 29
+	errnoNotdir     int32 = 54
+	errnoNotcapable int32 = 76
+)
+
+var wasiErrnos = map[syscall.Errno]int32{
+	syscall.E2BIG:        1,
+	syscall.EACCES:       2,
+	syscall.EAGAIN:       6,
+	syscall.EBADF:        8,
+	syscall.EBUSY:        10,
+	syscall.EEXIST:       20,
+	syscall.EFAULT:       21,
+	syscall.EFBIG:        22,
+	syscall.EINTR:        27,
+	syscall.EINVAL:       28,
+	syscall.EIO:          29,
+	syscall.EISDIR:       31,
+	syscall.ELOOP:        32,
+	syscall.EMFILE:       33,
+	syscall.EMLINK:       34,
+	syscall.ENAMETOOLONG: 37,
+	syscall.ENFILE:       41,
+	syscall.ENOENT:       44,
+	syscall.ENOMEM:       48,
+	syscall.ENOSPC:       51,
+	syscall.ENOSYS:       52,
+	syscall.ENOTDIR:      54,
+	syscall.ENOTEMPTY:    55,
+	syscall.ENOTSUP:      58,
+	syscall.ENOTTY:       59,
+	syscall.ENXIO:        60,
+	syscall.EPERM:        63,
+	syscall.EPIPE:        64,
+	syscall.EROFS:        69,
+	syscall.ESPIPE:       70,
+	syscall.ETXTBSY:      74,
+	syscall.EXDEV:        75,
+}
+
+// wasiErrno returns the wasi errno of err
+func wasiErrno(err error) int32 {
+	switch e := err.(type) {
+	case nil:
+		return errnoSuccess
+	case syscall.Errno:
+		if n, ok := wasiErrnos[e]; ok {
+			return n
+		}
+		return errnoIO
+	case *os.PathError:
+		return wasiErrno(e.Err)
+	case *os.LinkError:
+		return wasiErrno(e.Err)
+	case *os.SyscallError:
+		return wasiErrno(e.Err)
+	}
+	switch err {
+	case ErrOutOfBounds:
+		return errnoFault
+	case js.ErrNoSys:
+		// denied by the sandbox
+		return errnoNotcapable
+	case js.ErrInvalidArgument:
+		return errnoInval
+	}
+	return errnoIO
+}
+
+// wasi constants used by the imports
+const (
+	clockRealtime  = 0
+	clockMonotonic = 1
+
+	filetypeUnknown   = 0
+	filetypeBlock     = 1
+	filetypeChar      = 2
+	filetypeDirectory = 3
+	filetypeRegular   = 4
+	filetypeSocket    = 6
+	filetypeSymlink   = 7
+
+	fdflagAppend = 1 << 0
+	fdflagSync   = 1 << 4
+
+	oflagCreat     = 1 << 0
+	oflagDirectory = 1 << 1
+	oflagExcl      = 1 << 2
+	oflagTrunc     = 1 << 3
+
+	lookupSymlinkFollow = 1 << 0
+
+	rightFdRead  = 1 << 1
+	rightFdWrite = 1 << 6
+
+	eventtypeClock   = 0
+	subclockAbstime  = 1 << 0
+	subscriptionSize = 48
+	eventSize        = 32
+	direntSize       = 24
+	filestatSize     = 64
+)
+
+// exitUnwind is the panic unwinding the guest from proc_exit
+type exitUnwind struct {
+	code int32
+}
+
+func (e *exitUnwind) Error() string {
+	return fmt.Sprintf("gowasm: program exited with code %d", e.code)
+}
+
+func NewWASI() *WASI {
+	return newWASI(fs.NewFS(), newClock())
+}
+
+func newWASI(fs *fs.FS, clock clock) *WASI {
+	w := &WASI{
+		fs:     fs,
+		clock:  clock,
+		files:  make(map[int32]*wasiFile),
+		nextfd: 3,
+	}
+	for fd := 0; fd < 3; fd++ {
+		w.files[int32(fd)] = &wasiFile{fd: fd}
+	}
+	return w
+}
+
+// SetVM sets the wasm vm, Run requires it to implement Engine
+func (w *WASI) SetVM(vm VM) {
+	w.wvm = vm
+	w.engine, _ = vm.(Engine)
+}
+
+// FS returns the filesystem of the guest, opening files is denied until
+// its Sandbox is disabled
+func (w *WASI) FS() *fs.FS {
+	return w.fs
+}
+
+// Memory returns the bounds checked accessor of the guest memory
+func (w *WASI) Memory() *Memory {
+	return NewMemory(memoryFunc(func() []byte {
+		return w.wvm.Memory()
+	}))
+}
+
+// Preopen makes the host directory dir available to the guest as name,
+// the guest can then open the files below it
+func (w *WASI) Preopen(name, dir string) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "preopen", Path: dir, Err: err}
+	}
+	w.files[w.nextfd] = &wasiFile{
+		fd:      fd,
+		path:    dir,
+		name:    name,
+		preopen: true,
+	}
+	w.nextfd++
+	return nil
+}
+
+// Run runs the guest from _start with args and envs, until it returns or
+// calls proc_exit
+func (w *WASI) Run(args, envs []string) error {
+	if w.engine == nil {
+		return ErrNoEngine
+	}
+	if w.exited {
+		return ErrExited
+	}
+	w.args, w.envs = args, envs
+	err := w.callExport("_start")
+	if w.exited {
+		return nil
+	}
+	if err == nil {
+		w.exited = true
+	}
+	return err
+}
+
+// callExport calls the export name, a panic escaping the engine is
+// returned as the error
+func (w *WASI) callExport(name string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			var ok bool
+			if err, ok = v.(error); !ok {
+				err = fmt.Errorf("%s panicked: %v", name, v)
+			}
+		}
+	}()
+	_, err = w.engine.CallExport(name)
+	return err
+}
+
+// Exited reports whether the guest returned from _start or called
+// proc_exit
+func (w *WASI) Exited() bool {
+	return w.exited
+}
+
+func (w *WASI) ExitCode() int32 {
+	return w.exitcode
+}
+
+// Metrics returns a snapshot of the counters of the guest
+func (w *WASI) Metrics() *Metrics {
+	m := &Metrics{
+		Calls: make(map[string]uint64),
+	}
+	if w.calls != nil {
+		m.Calls = w.calls.Calls()
+	}
+	if w.wvm != nil {
+		m.PeakMemoryPages = int64(len(w.wvm.Memory()) / wasmPageSize)
+	}
+	m.BytesRead, m.BytesWritten = w.fs.BytesRead(), w.fs.BytesWritten()
+	return m
+}
+
+// Register registers the wasi functions to r.
+// If r counts calls per import, like Resolver, the counts are
+// reported by Metrics.
+func (w *WASI) Register(r FuncRegistry) {
+	if c, ok := r.(callCounter); ok {
+		w.calls = c
+	}
+	r.RegisterFunc(wasiModule, "args_get", w.argsGet)
+	r.RegisterFunc(wasiModule, "args_sizes_get", w.argsSizesGet)
+	r.RegisterFunc(wasiModule, "environ_get", w.environGet)
+	r.RegisterFunc(wasiModule, "environ_sizes_get", w.environSizesGet)
+	r.RegisterFunc(wasiModule, "clock_res_get", w.clockResGet)
+	r.RegisterFunc(wasiModule, "clock_time_get", w.clockTimeGet)
+	r.RegisterFunc(wasiModule, "fd_close", w.fdClose)
+	r.RegisterFunc(wasiModule, "fd_fdstat_get", w.fdFdstatGet)
+	r.RegisterFunc(wasiModule, "fd_fdstat_set_flags", w.fdFdstatSetFlags)
+	r.RegisterFunc(wasiModule, "fd_filestat_get", w.fdFilestatGet)
+	r.RegisterFunc(wasiModule, "fd_prestat_get", w.fdPrestatGet)
+	r.RegisterFunc(wasiModule, "fd_prestat_dir_name", w.fdPrestatDirName)
+	r.RegisterFunc(wasiModule, "fd_read", w.fdRead)
+	r.RegisterFunc(wasiModule, "fd_pread", w.fdPread)
+	r.RegisterFunc(wasiModule, "fd_write", w.fdWrite)
+	r.RegisterFunc(wasiModule, "fd_pwrite", w.fdPwrite)
+	r.RegisterFunc(wasiModule, "fd_readdir", w.fdReaddir)
+	r.RegisterFunc(wasiModule, "fd_seek", w.fdSeek)
+	r.RegisterFunc(wasiModule, "fd_sync", w.fdSync)
+	r.RegisterFunc(wasiModule, "path_create_directory", w.pathCreateDirectory)
+	r.RegisterFunc(wasiModule, "path_filestat_get", w.pathFilestatGet)
+	r.RegisterFunc(wasiModule, "path_open", w.pathOpen)
+	r.RegisterFunc(wasiModule, "path_remove_directory", w.pathRemoveDirectory)
+	r.RegisterFunc(wasiModule, "path_rename", w.pathRename)
+	r.RegisterFunc(wasiModule, "path_unlink_file", w.pathUnlinkFile)
+	r.RegisterFunc(wasiModule, "poll_oneoff", w.pollOneoff)
+	r.RegisterFunc(wasiModule, "proc_exit", w.procExit)
+	r.RegisterFunc(wasiModule, "random_get", w.randomGet)
+	r.RegisterFunc(wasiModule, "sched_yield", w.schedYield)
+}
+
+// stringsSizesGet writes the number of strs and the size of their buffer
+func stringsSizesGet(m *Memory, strs []string, count, size uint32) int32 {
+	n := 0
+	for _, s := range strs {
+		n += len(s) + 1
+	}
+	if err := m.WriteUint32(int64(count), uint32(len(strs))); err != nil {
+		return wasiErrno(err)
+	}
+	return wasiErrno(m.WriteUint32(int64(size), uint32(n)))
+}
+
+// stringsGet writes strs null terminated to buf and their addresses to ptrs
+func stringsGet(m *Memory, strs []string, ptrs, buf uint32) int32 {
+	p := int64(buf)
+	for i, s := range strs {
+		if err := m.WriteUint32(int64(ptrs)+int64(i)*4, uint32(p)); err != nil {
+			return wasiErrno(err)
+		}
+		if err := m.WriteString(p, s+"\x00"); err != nil {
+			return wasiErrno(err)
+		}
+		p += int64(len(s)) + 1
+	}
+	return errnoSuccess
+}
+
+func (w *WASI) argsGet(m *Memory, argv, buf uint32) int32 {
+	return stringsGet(m, w.args, argv, buf)
+}
+
+func (w *WASI) argsSizesGet(m *Memory, argc, size uint32) int32 {
+	return stringsSizesGet(m, w.args, argc, size)
+}
+
+func (w *WASI) environGet(m *Memory, env, buf uint32) int32 {
+	return stringsGet(m, w.envs, env, buf)
+}
+
+func (w *WASI) environSizesGet(m *Memory, count, size uint32) int32 {
+	return stringsSizesGet(m, w.envs, count, size)
+}
+
+// now returns the time of the clock id
+func (w *WASI) now(id uint32) (int64, bool) {
+	switch id {
+	case clockRealtime:
+		return w.clock.wall(), true
+	case clockMonotonic:
+		return w.clock.monotonic(), true
+	}
+	return 0, false
+}
+
+func (w *WASI) clockResGet(m *Memory, id uint32, res uint32) int32 {
+	if _, ok := w.now(id); !ok {
+		return errnoInval
+	}
+	return wasiErrno(m.WriteUint64(int64(res), 1))
+}
+
+func (w *WASI) clockTimeGet(m *Memory, id uint32, precision int64, t uint32) int32 {
+	now, ok := w.now(id)
+	if !ok {
+		return errnoInval
+	}
+	return wasiErrno(m.WriteUint64(int64(t), uint64(now)))
+}
+
+func (w *WASI) randomGet(m *Memory, buf, n uint32) int32 {
+	b, err := m.span(int64(buf), int64(n))
+	if err != nil {
+		return wasiErrno(err)
+	}
+	rand.Read(b)
+	return errnoSuccess
+}
+
+func (w *WASI) procExit(code int32) {
+	w.exitcode = code
+	w.exited = true
+	panic(&exitUnwind{code: code})
+}
+
+func (w *WASI) schedYield() int32 {
+	return errnoSuccess
+}
+
+// iovecs returns the buffers of the n iovecs at iovs
+func iovecs(m *Memory, iovs, n uint32) ([][]byte, error) {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		iov, err := m.span(int64(iovs)+int64(i)*8, 8)
+		if err != nil {
+			return nil, err
+		}
+		ptr := binary.LittleEndian.Uint32(iov)
+		size := binary.LittleEndian.Uint32(iov[4:])
+		if bufs[i], err = m.span(int64(ptr), int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	return bufs, nil
+}
+
+// rw reads or writes the iovecs of fd with f, until f moves less than a
+// whole buffer, and writes the number of bytes moved to nptr
+func (w *WASI) rw(m *Memory, fd, iovs, n, nptr uint32, f func(fd int, b []byte) (int, error)) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	bufs, err := iovecs(m, iovs, n)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	total := 0
+	for _, b := range bufs {
+		n, err := f(file.fd, b)
+		if n > 0 {
+			total += n
+		}
+		if err != nil {
+			return wasiErrno(err)
+		}
+		if n < len(b) {
+			break
+		}
+	}
+	return wasiErrno(m.WriteUint32(int64(nptr), uint32(total)))
+}
+
+func (w *WASI) fdRead(m *Memory, fd, iovs, n, nread uint32) int32 {
+	return w.rw(m, fd, iovs, n, nread, func(fd int, b []byte) (int, error) {
+		return w.fs.ReadSync(int64(fd), b, 0, int64(len(b)))
+	})
+}
+
+func (w *WASI) fdWrite(m *Memory, fd, iovs, n, nwritten uint32) int32 {
+	return w.rw(m, fd, iovs, n, nwritten, func(fd int, b []byte) (int, error) {
+		return w.fs.WriteSync(int64(fd), b, 0, int64(len(b)))
+	})
+}
+
+func (w *WASI) fdPread(m *Memory, fd, iovs, n uint32, offset int64, nread uint32) int32 {
+	return w.rw(m, fd, iovs, n, nread, func(fd int, b []byte) (int, error) {
+		n, err := syscall.Pread(fd, b, offset)
+		if n > 0 {
+			offset += int64(n)
+		}
+		return n, err
+	})
+}
+
+func (w *WASI) fdPwrite(m *Memory, fd, iovs, n uint32, offset int64, nwritten uint32) int32 {
+	return w.rw(m, fd, iovs, n, nwritten, func(fd int, b []byte) (int, error) {
+		n, err := syscall.Pwrite(fd, b, offset)
+		if n > 0 {
+			offset += int64(n)
+		}
+		return n, err
+	})
+}
+
+func (w *WASI) fdSeek(m *Memory, fd uint32, offset int64, whence uint32, newoffset uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	off, err := syscall.Seek(file.fd, offset, int(whence))
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return wasiErrno(m.WriteUint64(int64(newoffset), uint64(off)))
+}
+
+func (w *WASI) fdSync(fd uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	return wasiErrno(syscall.Fsync(file.fd))
+}
+
+func (w *WASI) fdClose(fd uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	delete(w.files, int32(fd))
+	// the stdio of the guest is the stdio of the host
+	if file.fd < 3 {
+		return errnoSuccess
+	}
+	return wasiErrno(w.fs.CloseSync(int64(file.fd)))
+}
+
+// statFiletype returns the wasi filetype of the st_mode mode
+func statFiletype(mode uint32) byte {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		return filetypeBlock
+	case syscall.S_IFCHR:
+		return filetypeChar
+	case syscall.S_IFDIR:
+		return filetypeDirectory
+	case syscall.S_IFREG:
+		return filetypeRegular
+	case syscall.S_IFSOCK:
+		return filetypeSocket
+	case syscall.S_IFLNK:
+		return filetypeSymlink
+	}
+	return filetypeUnknown
+}
+
+// modeFiletype returns the wasi filetype of mode
+func modeFiletype(mode os.FileMode) byte {
+	switch {
+	case mode.IsRegular():
+		return filetypeRegular
+	case mode&os.ModeDir != 0:
+		return filetypeDirectory
+	case mode&os.ModeSymlink != 0:
+		return filetypeSymlink
+	case mode&os.ModeSocket != 0:
+		return filetypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return filetypeChar
+	case mode&os.ModeDevice != 0:
+		return filetypeBlock
+	}
+	return filetypeUnknown
+}
+
+// writeFilestat writes the filestat of st to buf
+func writeFilestat(m *Memory, buf uint32, st *syscall.Stat_t) int32 {
+	b, err := m.span(int64(buf), filestatSize)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	atim, mtim, ctim := statTimes(st)
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], uint64(st.Dev))
+	le.PutUint64(b[8:], uint64(st.Ino))
+	b[16] = statFiletype(uint32(st.Mode))
+	le.PutUint64(b[24:], uint64(st.Nlink))
+	le.PutUint64(b[32:], uint64(st.Size))
+	le.PutUint64(b[40:], uint64(atim))
+	le.PutUint64(b[48:], uint64(mtim))
+	le.PutUint64(b[56:], uint64(ctim))
+	return errnoSuccess
+}
+
+func (w *WASI) fdFilestatGet(m *Memory, fd, buf uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	st, err := w.fs.FstatSync(int64(file.fd))
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return writeFilestat(m, buf, &st.Stat_t)
+}
+
+func (w *WASI) fdFdstatGet(m *Memory, fd, buf uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	st, err := w.fs.FstatSync(int64(file.fd))
+	if err != nil {
+		return wasiErrno(err)
+	}
+	b, err := m.span(int64(buf), 24)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	b[0], b[1] = statFiletype(uint32(st.Mode)), 0
+	binary.LittleEndian.PutUint16(b[2:], uint16(file.flags))
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	// rights are not enforced, every file has them all
+	binary.LittleEndian.PutUint64(b[8:], ^uint64(0))
+	binary.LittleEndian.PutUint64(b[16:], ^uint64(0))
+	return errnoSuccess
+}
+
+// fdFdstatSetFlags records the flags of fd, they are not applied to the host
+// file because the host stdio is shared with the guest
+func (w *WASI) fdFdstatSetFlags(fd, flags uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	file.flags = flags
+	return errnoSuccess
+}
+
+func (w *WASI) fdPrestatGet(m *Memory, fd, buf uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok || !file.preopen {
+		return errnoBadf
+	}
+	b, err := m.span(int64(buf), 8)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	binary.LittleEndian.PutUint32(b, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(file.name)))
+	return errnoSuccess
+}
+
+func (w *WASI) fdPrestatDirName(m *Memory, fd, buf, n uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok || !file.preopen {
+		return errnoBadf
+	}
+	if int(n) < len(file.name) {
+		return errnoInval
+	}
+	return wasiErrno(m.WriteString(int64(buf), file.name))
+}
+
+// fdReaddir lists the directory fd through its open fd rather than its
+// path, which may have been replaced since it was opened. The serial
+// numbers of the entries aren't reported, stating them would go through
+// the path.
+func (w *WASI) fdReaddir(m *Memory, fd, buf, size uint32, cookie int64, bufused uint32) int32 {
+	file, ok := w.files[int32(fd)]
+	if !ok {
+		return errnoBadf
+	}
+	if file.path == "" {
+		return errnoNotdir
+	}
+	out, err := m.span(int64(buf), int64(size))
+	if err != nil {
+		return wasiErrno(err)
+	}
+	entries, err := readDirFd(file.fd, file.path)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	// entries that don't fit are truncated, telling the guest to read again
+	// from the cookie of the last whole entry
+	n := 0
+	for i := cookie; i >= 0 && i < int64(len(entries)) && n < len(out); i++ {
+		e := entries[i]
+		var d [direntSize]byte
+		binary.LittleEndian.PutUint64(d[0:], uint64(i+1))
+		binary.LittleEndian.PutUint32(d[16:], uint32(len(e.Name())))
+		d[20] = modeFiletype(e.Type())
+		n += copy(out[n:], d[:])
+		n += copy(out[n:], e.Name())
+	}
+	return wasiErrno(m.WriteUint32(int64(bufused), uint32(n)))
+}
+
+// readDirFd returns the entries of the open directory fd sorted by name,
+// from the start whatever was read before. name is the path of fd, only
+// used by the systems not reporting the types of the entries.
+func readDirFd(fd int, name string) ([]os.DirEntry, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(dup), name)
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// resolve returns the host path of the path at ptr, relative to the
+// directory dirfd. Paths can't leave the directory, through .. or through
+// symlinks, the last element is only resolved if follow is true.
+func (w *WASI) resolve(m *Memory, dirfd, ptr, n uint32, follow bool) (string, int32) {
+	dir, ok := w.files[int32(dirfd)]
+	if !ok {
+		return "", errnoBadf
+	}
+	if dir.path == "" {
+		return "", errnoNotdir
+	}
+	p, err := m.ReadString(int64(ptr), int64(n))
+	if err != nil {
+		return "", wasiErrno(err)
+	}
+	if w.fs.Sandbox {
+		return "", errnoNotcapable
+	}
+	p = path.Clean(p)
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", errnoNotcapable
+	}
+	return beneath(dir.path, p, follow)
+}
+
+// beneath returns the host path of the clean relative path p below the
+// directory dir, with the symlinks resolved so that the host calls can't
+// follow one out of dir. The last element is left as is unless follow is
+// true, the calls not following it act on the link itself.
+func beneath(dir, p string, follow bool) (string, int32) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", wasiErrno(err)
+	}
+	parent, base := path.Split(p)
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(parent)))
+	if err != nil {
+		return "", wasiErrno(err)
+	}
+	resolved = filepath.Join(resolved, base)
+	if follow {
+		if fi, err := os.Lstat(resolved); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			// a dangling link fails here, rather than letting the
+			// guest create its target
+			if resolved, err = filepath.EvalSymlinks(resolved); err != nil {
+				return "", wasiErrno(err)
+			}
+		}
+	}
+	if resolved != root && !strings.HasPrefix(resolved, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+		return "", errnoNotcapable
+	}
+	return resolved, errnoSuccess
+}
+
+func (w *WASI) pathOpen(m *Memory, dirfd, dirflags, ptr, n, oflags uint32, rights, inheriting int64, fdflags, fdptr uint32) int32 {
+	p, errno := w.resolve(m, dirfd, ptr, n, dirflags&lookupSymlinkFollow != 0)
+	if errno != errnoSuccess {
+		return errno
+	}
+	flag := syscall.O_CLOEXEC
+	switch read, write := rights&rightFdRead != 0, rights&rightFdWrite != 0; {
+	case read && write:
+		flag |= syscall.O_RDWR
+	case write:
+		flag |= syscall.O_WRONLY
+	default:
+		flag |= syscall.O_RDONLY
+	}
+	if oflags&oflagCreat != 0 {
+		flag |= syscall.O_CREAT
+	}
+	if oflags&oflagDirectory != 0 {
+		flag |= syscall.O_DIRECTORY
+	}
+	if oflags&oflagExcl != 0 {
+		flag |= syscall.O_EXCL
+	}
+	if oflags&oflagTrunc != 0 {
+		flag |= syscall.O_TRUNC
+	}
+	if fdflags&fdflagAppend != 0 {
+		flag |= syscall.O_APPEND
+	}
+	if fdflags&fdflagSync != 0 {
+		flag |= syscall.O_SYNC
+	}
+	if dirflags&lookupSymlinkFollow == 0 {
+		flag |= syscall.O_NOFOLLOW
+	}
+	fd, err := w.fs.OpenSync(p, int64(flag), 0666)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	file := &wasiFile{
+		fd:    fd,
+		flags: fdflags,
+	}
+	if st, err := w.fs.FstatSync(int64(fd)); err == nil && st.IsDirectory() {
+		file.path = p
+	}
+	id := w.nextfd
+	if errno := wasiErrno(m.WriteUint32(int64(fdptr), uint32(id))); errno != errnoSuccess {
+		w.fs.CloseSync(int64(fd))
+		return errno
+	}
+	w.files[id] = file
+	w.nextfd++
+	return errnoSuccess
+}
+
+func (w *WASI) pathFilestatGet(m *Memory, dirfd, flags, ptr, n, buf uint32) int32 {
+	p, errno := w.resolve(m, dirfd, ptr, n, flags&lookupSymlinkFollow != 0)
+	if errno != errnoSuccess {
+		return errno
+	}
+	var st syscall.Stat_t
+	var err error
+	if flags&lookupSymlinkFollow != 0 {
+		err = syscall.Stat(p, &st)
+	} else {
+		err = syscall.Lstat(p, &st)
+	}
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return writeFilestat(m, buf, &st)
+}
+
+func (w *WASI) pathCreateDirectory(m *Memory, dirfd, ptr, n uint32) int32 {
+	p, errno := w.resolve(m, dirfd, ptr, n, false)
+	if errno != errnoSuccess {
+		return errno
+	}
+	return wasiErrno(syscall.Mkdir(p, 0777))
+}
+
+func (w *WASI) pathRemoveDirectory(m *Memory, dirfd, ptr, n uint32) int32 {
+	p, errno := w.resolve(m, dirfd, ptr, n, false)
+	if errno != errnoSuccess {
+		return errno
+	}
+	return wasiErrno(syscall.Rmdir(p))
+}
+
+func (w *WASI) pathUnlinkFile(m *Memory, dirfd, ptr, n uint32) int32 {
+	p, errno := w.resolve(m, dirfd, ptr, n, false)
+	if errno != errnoSuccess {
+		return errno
+	}
+	return wasiErrno(syscall.Unlink(p))
+}
+
+func (w *WASI) pathRename(m *Memory, olddirfd, oldptr, oldn, newdirfd, newptr, newn uint32) int32 {
+	from, errno := w.resolve(m, olddirfd, oldptr, oldn, false)
+	if errno != errnoSuccess {
+		return errno
+	}
+	to, errno := w.resolve(m, newdirfd, newptr, newn, false)
+	if errno != errnoSuccess {
+		return errno
+	}
+	return wasiErrno(syscall.Rename(from, to))
+}
+
+// pollOneoff waits for the earliest clock subscription. Files are always
+// ready, reads and writes block the guest instead.
+func (w *WASI) pollOneoff(m *Memory, in, out, nsubs, nevents uint32) int32 {
+	if nsubs == 0 {
+		return errnoInval
+	}
+	subs, err := m.span(int64(in), int64(nsubs)*subscriptionSize)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	events, err := m.span(int64(out), int64(nsubs)*eventSize)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	le := binary.LittleEndian
+
+	// delays are the delays of the clock subscriptions, -1 for the others
+	delays := make([]int64, nsubs)
+	wait := int64(-1)
+	for i := range delays {
+		sub := subs[i*subscriptionSize:]
+		delays[i] = -1
+		if sub[8] != eventtypeClock {
+			wait = 0
+			continue
+		}
+		id, timeout := le.Uint32(sub[16:]), int64(le.Uint64(sub[24:]))
+		d := timeout
+		if le.Uint16(sub[40:])&subclockAbstime != 0 {
+			now, _ := w.now(id)
+			d = timeout - now
+		}
+		if d < 0 {
+			d = 0
+		}
+		delays[i] = d
+		if wait < 0 || d < wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(time.Duration(wait))
+	}
+
+	n := 0
+	for i, d := range delays {
+		sub := subs[i*subscriptionSize:]
+		if d > wait {
+			continue
+		}
+		ev := events[n*eventSize : (n+1)*eventSize]
+		for j := range ev {
+			ev[j] = 0
+		}
+		copy(ev, sub[:8])
+		ev[10] = sub[8]
+		if d < 0 {
+			if _, ok := w.files[int32(le.Uint32(sub[16:]))]; !ok {
+				le.PutUint16(ev[8:], uint16(errnoBadf))
+			}
+		}
+		n++
+	}
+	return wasiErrno(m.WriteUint32(int64(nevents), uint32(n)))
+}
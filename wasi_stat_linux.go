@@ -0,0 +1,9 @@
+package gowasm
+
+import "syscall"
+
+// statTimes returns the access, modification and change times of st in
+// nanoseconds since the unix epoch
+func statTimes(st *syscall.Stat_t) (atim, mtim, ctim int64) {
+	return st.Atim.Nano(), st.Mtim.Nano(), st.Ctim.Nano()
+}
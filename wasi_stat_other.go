@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package gowasm
+
+import "syscall"
+
+// statTimes returns zero times, the layout of syscall.Stat_t differs on
+// this system
+func statTimes(st *syscall.Stat_t) (atim, mtim, ctim int64) {
+	return 0, 0, 0
+}
@@ -0,0 +1,110 @@
+package gowasm
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBeneath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.Mkdir(filepath.Join(dir, "sub"), 0777))
+	must(ioutil.WriteFile(filepath.Join(dir, "sub", "file"), nil, 0666))
+	must(os.Symlink("sub", filepath.Join(dir, "in")))
+	must(os.Symlink(outside, filepath.Join(dir, "out")))
+	must(os.Symlink("../..", filepath.Join(dir, "sub", "up")))
+	must(os.Symlink(filepath.Join(outside, "missing"), filepath.Join(dir, "dangling")))
+
+	tests := []struct {
+		path   string
+		follow bool
+		want   string // relative to dir, empty if refused
+	}{
+		{path: ".", want: "."},
+		{path: "sub/file", want: "sub/file"},
+		{path: "in/file", want: "sub/file"},
+		{path: "in", want: "in"},
+		{path: "in", follow: true, want: "sub"},
+		{path: "out", want: "out"},
+		{path: "out", follow: true},
+		{path: "out/file"},
+		{path: "sub/up/x"},
+		{path: "sub/up", want: "sub/up"},
+		{path: "sub/up", follow: true},
+		{path: "dangling", want: "dangling"},
+		{path: "dangling", follow: true},
+		{path: "missing/file"},
+	}
+	for _, test := range tests {
+		got, errno := beneath(dir, test.path, test.follow)
+		if test.want == "" {
+			if errno == errnoSuccess {
+				t.Errorf("beneath(%q, follow %v) = %s, want it refused", test.path, test.follow, got)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, test.want); errno != errnoSuccess || got != want {
+			t.Errorf("beneath(%q, follow %v) = %s, %d, want %s", test.path, test.follow, got, errno, want)
+		}
+	}
+}
+
+// TestReaddirSwapped checks that fd_readdir lists the directory opened,
+// even once its path leads to another one
+func TestReaddirSwapped(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "dir")
+	outside := t.TempDir()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.Mkdir(dir, 0777))
+	must(ioutil.WriteFile(filepath.Join(dir, "b"), nil, 0666))
+	must(os.Mkdir(filepath.Join(dir, "a"), 0777))
+	must(ioutil.WriteFile(filepath.Join(outside, "secret"), nil, 0666))
+
+	w := NewWASI()
+	w.fs.Sandbox = false
+	must(w.Preopen("/", dir))
+	must(os.Rename(dir, dir+".old"))
+	must(os.Symlink(outside, dir))
+
+	mem := make([]byte, wasmPageSize)
+	m := NewMemory(memoryFunc(func() []byte { return mem }))
+	const buf, size, bufused = 1024, 1024, 0
+	for i := 0; i < 2; i++ {
+		if errno := w.fdReaddir(m, 3, buf, size, 0, bufused); errno != errnoSuccess {
+			t.Fatalf("fd_readdir: errno %d", errno)
+		}
+		n, _ := m.ReadUint32(bufused)
+		var names []string
+		types := make(map[string]byte)
+		for b := mem[buf : buf+n]; len(b) >= direntSize; {
+			namelen := binary.LittleEndian.Uint32(b[16:])
+			name := string(b[direntSize : direntSize+namelen])
+			names = append(names, name)
+			types[name] = b[20]
+			b = b[direntSize+namelen:]
+		}
+		if strings.Join(names, " ") != "a b" {
+			t.Errorf("listed %q, want a and b", names)
+		}
+		if types["a"] != filetypeDirectory || types["b"] != filetypeRegular {
+			t.Errorf("types %v, want a directory and a regular file", types)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package gowasm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync/atomic"
+)
+
+// ValueType is the type of a wasm value
+type ValueType byte
+
+const (
+	I32 ValueType = iota
+	I64
+	F32
+	F64
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case I32:
+		return "i32"
+	case I64:
+		return "i64"
+	case F32:
+		return "f32"
+	case F64:
+		return "f64"
+	}
+	return fmt.Sprintf("ValueType(%d)", byte(t))
+}
+
+// Signature is the wasm signature of an import
+type Signature struct {
+	Params  []ValueType
+	Results []ValueType
+	// Frame is true for the functions registered with Register, whose only
+	// parameter is the sp of the frame laid out by the Go compiler
+	Frame bool
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("%v -> %v", s.Params, s.Results)
+}
+
+// frameSignature is the signature of the functions taking a frame
+var frameSignature = Signature{
+	Params: []ValueType{I32},
+	Frame:  true,
+}
+
+var memoryType = reflect.TypeOf((*Memory)(nil))
+
+// wasmFunc is a host function called with the plain wasm calling convention
+type wasmFunc struct {
+	fn     reflect.Value
+	memory bool // the first parameter is the *Memory of the guest
+	in     []reflect.Type
+	sig    Signature
+}
+
+// valueType returns the wasm type of values of type t
+func valueType(t reflect.Type) (ValueType, bool) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int32, reflect.Uint32:
+		return I32, true
+	case reflect.Int64, reflect.Uint64:
+		return I64, true
+	case reflect.Float32:
+		return F32, true
+	case reflect.Float64:
+		return F64, true
+	}
+	return 0, false
+}
+
+func newWasmFunc(f interface{}) (*wasmFunc, error) {
+	t := reflect.TypeOf(f)
+	if t == nil || t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a function", t)
+	}
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("variadic function %s", t)
+	}
+	w := &wasmFunc{
+		fn: reflect.ValueOf(f),
+	}
+	for i := 0; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if i == 0 && in == memoryType {
+			w.memory = true
+			continue
+		}
+		vt, ok := valueType(in)
+		if !ok {
+			return nil, fmt.Errorf("unsupported parameter type %s", in)
+		}
+		w.in = append(w.in, in)
+		w.sig.Params = append(w.sig.Params, vt)
+	}
+	if t.NumOut() > 1 {
+		return nil, fmt.Errorf("%s returns more than one result", t)
+	}
+	if t.NumOut() == 1 {
+		vt, ok := valueType(t.Out(0))
+		if !ok {
+			return nil, fmt.Errorf("unsupported result type %s", t.Out(0))
+		}
+		w.sig.Results = []ValueType{vt}
+	}
+	return w, nil
+}
+
+// fromWasm returns the value of type t of the raw wasm value v
+func fromWasm(t reflect.Type, v int64) reflect.Value {
+	x := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		x.SetBool(uint32(v) != 0)
+	case reflect.Int32:
+		x.SetInt(int64(int32(v)))
+	case reflect.Int64:
+		x.SetInt(v)
+	case reflect.Uint32:
+		x.SetUint(uint64(uint32(v)))
+	case reflect.Uint64:
+		x.SetUint(uint64(v))
+	case reflect.Float32:
+		x.SetFloat(float64(math.Float32frombits(uint32(v))))
+	case reflect.Float64:
+		x.SetFloat(math.Float64frombits(uint64(v)))
+	}
+	return x
+}
+
+// toWasm returns the raw wasm value of x
+func toWasm(x reflect.Value) int64 {
+	switch x.Kind() {
+	case reflect.Bool:
+		if x.Bool() {
+			return 1
+		}
+	case reflect.Int32, reflect.Int64:
+		return x.Int()
+	case reflect.Uint32, reflect.Uint64:
+		return int64(x.Uint())
+	case reflect.Float32:
+		return int64(math.Float32bits(float32(x.Float())))
+	case reflect.Float64:
+		return int64(math.Float64bits(x.Float()))
+	}
+	return 0
+}
+
+func (w *wasmFunc) call(vm VM, args []int64) int64 {
+	var in []reflect.Value
+	if w.memory {
+		in = append(in, reflect.ValueOf(NewMemory(vm)))
+	}
+	for i, t := range w.in {
+		in = append(in, fromWasm(t, args[i]))
+	}
+	out := w.fn.Call(in)
+	if len(out) == 0 {
+		return 0
+	}
+	return toWasm(out[0])
+}
+
+// RegisterFunc registers f as the import module.field called with the plain
+// wasm calling convention, as the functions declared with //go:wasmimport:
+// the parameters are wasm values instead of a frame in memory. It panics if
+// a parameter or result type has no wasm type.
+//
+// Parameters and the result can be bools, 32 and 64 bit integers and floats.
+// Pointers to the guest memory are uint32 offsets, which f can access with a
+// *Memory first parameter.
+func (r *Resolver) RegisterFunc(module, field string, f interface{}) {
+	w, err := newWasmFunc(f)
+	if err != nil {
+		panic(fmt.Sprintf("gowasm: register %s.%s: %s", module, field, err))
+	}
+	r.modules[importKey{module, field}] = &method{
+		Module: module,
+		Field:  field,
+		Type:   w.fn.Type(),
+		Func:   w.fn,
+		wasm:   w,
+	}
+}
+
+// Signature returns the wasm signature of the import module.field, false
+// if it's not registered
+func (r *Resolver) Signature(module, field string) (Signature, bool) {
+	m, ok := r.modules[importKey{module, field}]
+	if !ok {
+		return Signature{}, false
+	}
+	if m.stub != nil {
+		return *m.stub, true
+	}
+	if m.wasm != nil {
+		return m.wasm.sig, true
+	}
+	return frameSignature, true
+}
+
+// CallFunc calls the import module.field with the raw wasm values args:
+// i32 values are in the low 32 bits, f32 and f64 values are their IEEE 754
+// bits. It returns the raw result, or 0. Functions taking a frame are
+// called with the sp args[0].
+func (r *Resolver) CallFunc(module, field string, vm VM, args []int64) int64 {
+	if r.trace {
+		r.logger.Printf("call %s.%s", module, field)
+	}
+	if r.profiler != nil {
+		r.profiler.record()
+	}
+	defer recoverHostPanic(module, field)
+	m, ok := r.modules[importKey{module, field}]
+	if !ok {
+		panic(&Fault{Import: module + "." + field, Reason: "import not found"})
+	}
+	if m.stub != nil {
+		return r.callStub(m)
+	}
+	atomic.AddUint64(&m.calls, 1)
+	if m.wasm == nil {
+		if len(args) != 1 {
+			panic(&Fault{Import: module + "." + field, Reason: fmt.Sprintf("called with %d arguments, want the sp", len(args))})
+		}
+		return r.callMethod(m, vm, args[0])
+	}
+	if len(args) != len(m.wasm.in) {
+		panic(&Fault{Import: module + "." + field, Reason: fmt.Sprintf("called with %d arguments, want %d", len(args), len(m.wasm.in))})
+	}
+	return m.wasm.call(vm, args)
+}